@@ -1,9 +1,11 @@
 package auth
 
 import (
+	"context"
 	"errors"
 	"github.com/jmoiron/sqlx"
 	"github.com/stockholmr/database"
+	"strings"
 	"time"
 )
 
@@ -12,120 +14,2508 @@ func Register(db *sqlx.DB, email string, password string) error {
 		return err
 	}
 
+	if isInvitationOnly() {
+		return errors.New(ERROR_INVITATIONONLY)
+	}
+
+	if !validateEmail(email) {
+		return errors.New(ERROR_INVALIDEMAIL)
+	}
+
+	if err := checkRegistrationEmail(email); err != nil {
+		return err
+	}
+
+	if err := checkPassword(password, email); err != nil {
+		return err
+	}
+
+	// hashed up front so an existing address is not answered faster
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if isEnumerationSafe() {
+		count, err := dbGetUserCountByEmail(db, email)
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			return concealAccountError(email, NOTICE_ACCOUNT_EXISTS, errors.New(ERROR_EMAILTAKEN))
+		}
+	}
+
+	user := NewUser(email, hash, time.Now().Unix())
+	if isModerated() {
+		user.SetStatus(STATUS_PENDING_REVIEW)
+	}
+	user.SetVerified(true)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	_, err = dbTxCreateUser(tx, user)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RegisterWithConfirmation creates an unverified user and calls confirmEmail
+// once it is stored. If confirmEmail fails the user is deleted again, so the
+// address can be registered again.
+func RegisterWithConfirmation(db *sqlx.DB, email string, password string, confirmEmail SelectorTokenCallBack) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	if isInvitationOnly() {
+		return errors.New(ERROR_INVITATIONONLY)
+	}
+
+	if !validateEmail(email) {
+		return errors.New(ERROR_INVALIDEMAIL)
+	}
+
+	if err := checkRegistrationEmail(email); err != nil {
+		return err
+	}
+
+	if err := checkPassword(password, email); err != nil {
+		return err
+	}
+
+	// hashed up front so an existing address is not answered faster
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if isEnumerationSafe() {
+		count, err := dbGetUserCountByEmail(db, email)
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			return concealAccountError(email, NOTICE_ACCOUNT_EXISTS, errors.New(ERROR_EMAILTAKEN))
+		}
+	}
+
+	user := NewUser(email, hash, time.Now().Unix())
+	if isModerated() {
+		user.SetStatus(STATUS_PENDING_REVIEW)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	id, err := dbTxCreateUser(tx, user)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	user.ID = newNullInt64(id)
+
+	// in CONFIRMATION_CODE mode confirmEmail gets an empty selector
+	var selector, token string
+	if getConfirmationMethod() == CONFIRMATION_CODE {
+		code, err := txIssueCode(tx, id, CODE_CONFIRM, email)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		token = code.GetCode()
+	} else {
+		confirm := NewUserConfirmation(id, email, getUserConfirmationExpiry())
+
+		_, err = dbTxCreateUserConfirmation(tx, confirm)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		err = dbTxUpdateUserConfirmationSent(tx, id, 0)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		selector, token = confirm.GetSelector(), confirm.GetToken()
+	}
+
+	queued, err := txQueueCallBack(tx, confirmEmail, selector, token)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if queued {
+		return nil
+	}
+
+	err = confirmEmail(selector, token)
+	if err != nil {
+		// an address nobody can confirm must stay free to register
+		_ = dbHardDeleteUser(db, user)
+		return err
+	}
+
+	return nil
+}
+
+// Invite sends email a link to RegisterWithInvitation. The account created
+// through it is verified and has roles. A new invitation for the same
+// address replaces the previous one.
+func Invite(db *sqlx.DB, inviterID int64, email string, roles int64, sendInvite SelectorTokenCallBack) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
 	if !validateEmail(email) {
 		return errors.New(ERROR_INVALIDEMAIL)
 	}
 
-	user := NewUser(email, hashPassword(password), time.Now().Unix())
+	if err := checkRegistrationEmail(email); err != nil {
+		return err
+	}
+
+	count, err := dbGetUserCountByEmail(db, email)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return errors.New(ERROR_EMAILTAKEN)
+	}
+
+	invitation := NewUserInvitation(inviterID, email, roles, getUserInvitationExpiry())
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = dbTxDeleteUserInvitationByEmail(tx, email)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	invitationID, err := dbTxCreateUserInvitation(tx, invitation)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	queued, err := txQueueCallBack(tx, sendInvite, invitation.GetSelector(), invitation.GetToken())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if queued {
+		return nil
+	}
+
+	err = sendInvite(invitation.GetSelector(), invitation.GetToken())
+	if err != nil {
+		_, _ = dbDeleteUserInvitation(db, invitationID)
+		return err
+	}
+
+	return nil
+}
+
+// RegisterWithInvitation creates the account an invitation was sent for
+// and returns its ID. It works while SetInvitationOnly is enabled.
+func RegisterWithInvitation(db *sqlx.DB, selector string, token string, password string) (int64, error) {
+	if err := checkDatabase(db); err != nil {
+		return -999, err
+	}
+
+	invitation, err := dbGetUserInvitationBySelector(db, selector)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return -999, errors.New(ERROR_INVALIDSELECTOR)
+		}
+		return -999, err
+	}
+
+	if !verifyHash(invitation.Token.String, token) {
+		return -999, errors.New(ERROR_INVALIDTOKEN)
+	}
+
+	if invitation.HasExpired() {
+		return -999, errors.New(ERROR_TOKENEXPIRED)
+	}
+
+	email := invitation.Email.String
+
+	if err := checkPassword(password, email); err != nil {
+		return -999, err
+	}
+
+	count, err := dbGetUserCountByEmail(db, email)
+	if err != nil {
+		return -999, err
+	}
+
+	if count > 0 {
+		return -999, errors.New(ERROR_EMAILTAKEN)
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return -999, err
+	}
+
+	user := NewUser(email, hash, time.Now().Unix())
+	user.SetVerified(true)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return -999, err
+	}
+
+	deleted, err := dbTxDeleteUserInvitation(tx, selector)
+	if err != nil {
+		_ = tx.Rollback()
+		return -999, err
+	}
+
+	// someone else used the invitation first
+	if deleted != 1 {
+		_ = tx.Rollback()
+		return -999, errors.New(ERROR_INVALIDSELECTOR)
+	}
+
+	id, err := dbTxCreateUser(tx, user)
+	if err != nil {
+		_ = tx.Rollback()
+		return -999, err
+	}
+
+	err = dbTxUpdateUserRoles(tx, id, invitation.Roles.Int64)
+	if err != nil {
+		_ = tx.Rollback()
+		return -999, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return -999, err
+	}
+
+	return id, nil
+}
+
+// GetPendingInvitations returns the invitations that have not been used,
+// revoked or expired.
+func GetPendingInvitations(db *sqlx.DB) ([]*UserInvitation, error) {
+	if err := checkDatabase(db); err != nil {
+		return nil, err
+	}
+
+	return dbGetUserInvitationsPending(db, time.Now().Unix())
+}
+
+// RevokeInvitation deletes a pending invitation, so its link stops working.
+func RevokeInvitation(db *sqlx.DB, invitationID int64) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	deleted, err := dbDeleteUserInvitation(db, invitationID)
+	if err != nil {
+		return err
+	}
+
+	if deleted != 1 {
+		return errors.New(ERROR_INVALIDSELECTOR)
+	}
+
+	return nil
+}
+
+// GetPendingReviews returns the accounts waiting for Approve or Reject.
+func GetPendingReviews(db *sqlx.DB) ([]*User, error) {
+	if err := checkDatabase(db); err != nil {
+		return nil, err
+	}
+
+	return dbGetUsersByStatus(db, STATUS_PENDING_REVIEW)
+}
+
+// Approve lets an account held by SetModeration log in.
+func Approve(db *sqlx.DB, userID int64, reviewerID int64, reason string) error {
+	return reviewUser(db, userID, reviewerID, REVIEW_APPROVED, reason)
+}
+
+// Reject archives an account held by SetModeration. Its address is released
+// and can register again.
+func Reject(db *sqlx.DB, userID int64, reviewerID int64, reason string) error {
+	return reviewUser(db, userID, reviewerID, REVIEW_REJECTED, reason)
+}
+
+// Suspend blocks a user until the given time, after which Login and
+// LiftExpiredSuspensions reinstate the account. Remember tokens are deleted
+// and force_logout is incremented so running sessions end. Only active and
+// suspended accounts can be suspended; a ban is not shortened by one.
+func Suspend(db *sqlx.DB, userID int64, until time.Time, reason string, actorID int64) error {
+	if !until.After(time.Now()) {
+		return errors.New(ERROR_INVALIDUNTIL)
+	}
+	return blockUser(db, userID, STATUS_SUSPENDED, until.Unix(), reason, actorID, AUDIT_USER_SUSPENDED)
+}
+
+// Ban blocks an active, suspended or banned user until Reinstate is called.
+func Ban(db *sqlx.DB, userID int64, reason string, actorID int64) error {
+	return blockUser(db, userID, STATUS_BANNED, 0, reason, actorID, AUDIT_USER_BANNED)
+}
+
+// Reinstate lifts a suspension or ban.
+func Reinstate(db *sqlx.DB, userID int64, reason string, actorID int64) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	user, err := dbGetUserByIDNotArchived(db, userID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	if user.Status.Int64 != STATUS_SUSPENDED && user.Status.Int64 != STATUS_BANNED {
+		return errors.New(ERROR_INVALIDUSERID)
+	}
+
+	return reinstateUser(db, user, reason, actorID)
+}
+
+// GetBlockReason returns the status change that blocked a user, for
+// example to show an administrator why Login returned ERROR_USERSUSPENDED
+// or ERROR_USERBLOCKED.
+func GetBlockReason(db *sqlx.DB, userID int64) (*UserStatusChange, error) {
+	if err := checkDatabase(db); err != nil {
+		return nil, err
+	}
+
+	change, err := dbGetLatestUserStatusChange(db, userID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, errors.New(ERROR_INVALIDUSERID)
+		}
+		return nil, err
+	}
+
+	return change, nil
+}
+
+// LiftExpiredSuspensions reinstates every user whose suspension has ended
+// and returns how many there were.
+func LiftExpiredSuspensions(db *sqlx.DB) (int64, error) {
+	if err := checkDatabase(db); err != nil {
+		return -999, err
+	}
+
+	users, err := dbGetUsersSuspensionOver(db, time.Now().Unix())
+	if err != nil {
+		return -999, err
+	}
+
+	var lifted int64
+	for _, user := range users {
+		err = reinstateUser(db, user, "suspension ended", 0)
+		if err != nil {
+			// changed since it was read, for example banned
+			if err.Error() == ERROR_STATUSCHANGED {
+				continue
+			}
+			return lifted, err
+		}
+		lifted++
+	}
+
+	return lifted, nil
+}
+
+// RunSuspensionSweeper calls LiftExpiredSuspensions every interval until ctx
+// is cancelled. Errors are handed to onError, which may be nil, and the next
+// tick tries again.
+func RunSuspensionSweeper(ctx context.Context, db *sqlx.DB, interval time.Duration, onError func(err error)) error {
+	if interval <= 0 {
+		return errors.New(ERROR_INVALIDINTERVAL)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_, err := LiftExpiredSuspensions(db)
+		if err != nil && onError != nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// RequestAccountDeletion archives the account of a user who confirmed it
+// with their password. Every token and session is revoked at once and the
+// account is purged after the grace period set by SetDeletionGracePeriod,
+// unless the link sent through sendCancel is passed to
+// CancelAccountDeletion first.
+func RequestAccountDeletion(db *sqlx.DB, userID int64, password string, sendCancel SelectorTokenCallBack) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	user, err := dbGetUserByID(db, userID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	if !verifyHash(user.Password.String, password) {
+		return errors.New(ERROR_INVALIDPASSWORD)
+	}
+
+	deletion := NewUserDeletion(user.GetID(), getDeletionPurgeTime())
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = txRevokeUserCredentials(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = txChangeUserStatus(tx, user, NewUserStatusChange(user.GetID(), STATUS_ARCHIVED, "deletion requested", user.GetID(), deletion.Purge.Int64))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = dbTxCreateUserDeletion(tx, deletion)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = txEmitAuditEvent(tx, user.GetID(), AUDIT_DELETION_REQUEST)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	queued, err := txQueueCallBack(tx, sendCancel, deletion.GetSelector(), deletion.GetToken())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	notifyAuditEvent(user.GetID(), AUDIT_DELETION_REQUEST)
+
+	if queued {
+		return nil
+	}
+
+	// without the link the user could not change their mind
+	err = sendCancel(deletion.GetSelector(), deletion.GetToken())
+	if err != nil {
+		_ = CancelAccountDeletion(db, deletion.GetSelector(), deletion.GetToken())
+		return err
+	}
+
+	return nil
+}
+
+// CancelAccountDeletion restores an account archived by
+// RequestAccountDeletion. The user has to log in again.
+func CancelAccountDeletion(db *sqlx.DB, selector string, token string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	deletion, err := dbGetUserDeletionBySelector(db, selector)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDSELECTOR)
+		}
+		return err
+	}
+
+	if !verifyHash(deletion.Token.String, token) {
+		return errors.New(ERROR_INVALIDTOKEN)
+	}
+
+	if deletion.IsDue() {
+		return errors.New(ERROR_TOKENEXPIRED)
+	}
+
+	user, err := dbGetUserByIDAndStatus(db, deletion.UserID.Int64, STATUS_ARCHIVED)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	deleted, err := dbTxDeleteUserDeletion(tx, selector)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// someone else used the link first
+	if deleted != 1 {
+		_ = tx.Rollback()
+		return errors.New(ERROR_INVALIDSELECTOR)
+	}
+
+	err = txChangeUserStatus(tx, user, NewUserStatusChange(user.GetID(), STATUS_NORMAL, "deletion cancelled", user.GetID(), 0))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = txEmitAuditEvent(tx, user.GetID(), AUDIT_DELETION_CANCEL)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	notifyAuditEvent(user.GetID(), AUDIT_DELETION_CANCEL)
+	return nil
+}
+
+// PurgeDeletedAccounts removes the accounts whose deletion grace period has
+// ended, together with every row that refers to them, and returns how many
+// there were.
+func PurgeDeletedAccounts(db *sqlx.DB) (int64, error) {
+	if err := checkDatabase(db); err != nil {
+		return -999, err
+	}
+
+	ids, err := dbGetUserIDsDeletionDue(db, time.Now().Unix())
+	if err != nil {
+		return -999, err
+	}
+
+	var purged int64
+	for _, id := range ids {
+		tx, err := db.Beginx()
+		if err != nil {
+			return purged, err
+		}
+
+		err = txPurgeUser(tx, id)
+		if err != nil {
+			_ = tx.Rollback()
+			return purged, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// ExportUserData returns everything stored about a user as an indented
+// JSON document, whatever the status of the account. Password hashes,
+// tokens and codes are redacted.
+func ExportUserData(db *sqlx.DB, userID int64) ([]byte, error) {
+	if err := checkDatabase(db); err != nil {
+		return nil, err
+	}
+
+	user, err := dbGetUserByIDAnyStatus(db, userID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, errors.New(ERROR_INVALIDUSERID)
+		}
+		return nil, err
+	}
+
+	export, err := buildUserExport(db, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalUserExport(export)
+}
+
+// ExportUserDataZip returns the document of ExportUserData as
+// user-data.json inside a zip archive.
+func ExportUserDataZip(db *sqlx.DB, userID int64) ([]byte, error) {
+	doc, err := ExportUserData(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return zipUserExport(doc)
+}
+func ResendConfirmation(db *sqlx.DB, email string, confirmEmail SelectorTokenCallBack) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	if !validateEmail(email) {
+		return errors.New(ERROR_INVALIDEMAIL)
+	}
+
+	user, err := getConfirmableUserByEmail(db, email)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return concealUnknownAccount(errors.New(ERROR_INVALIDEMAIL))
+		}
+		return err
+	}
+
+	// answered like an unknown address, nothing is sent either way
+	if user.IsVerified() {
+		return concealUnknownAccount(errors.New(ERROR_ALREADYVERIFIED))
+	}
+
+	sinceLastSent := time.Now().Unix() - user.ConfirmationSent.Int64
+	if sinceLastSent < getConfirmationResendCooldown() {
+		return concealUnknownAccount(errors.New(ERROR_RESENDCOOLDOWN))
+	}
+
+	resends := user.ConfirmationResends.Int64
+	if sinceLastSent >= getConfirmationResendWindow() {
+		resends = 0
+	}
+
+	if resends >= getMaxConfirmationResends() {
+		return concealUnknownAccount(errors.New(ERROR_TOOMANYREQUESTS))
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	// earlier links stop working once a new one is issued
+	err = dbTxDeleteUserConfirmationAllByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	confirm := NewUserConfirmation(user.GetID(), user.Email.String, getUserConfirmationExpiry())
+
+	_, err = dbTxCreateUserConfirmation(tx, confirm)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxUpdateUserConfirmationSent(tx, user.GetID(), resends+1)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	queued, err := txQueueCallBack(tx, confirmEmail, confirm.GetSelector(), confirm.GetToken())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if queued {
+		return nil
+	}
+
+	err = confirmEmail(confirm.GetSelector(), confirm.GetToken())
+	if err != nil {
+		_ = dbDeleteUserConfirmation(db, confirm.GetSelector())
+		return err
+	}
+
+	return nil
+}
+func ConfirmEmail(db *sqlx.DB, selector string, token string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	confirm, err := dbGetUserConfirmationBySelector(db, selector)
+	if err != nil {
+		return err
+	}
+
+	if !verifyHash(confirm.Token.String, token) {
+		return errors.New(ERROR_INVALIDTOKEN)
+	}
+
+	if confirm.HasExpired() {
+		return errors.New(ERROR_TOKENEXPIRED)
+	}
+
+	user, err := getConfirmableUserByID(db, confirm.UserID.Int64)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	if emailKey(confirm.Email.String) != user.EmailKey.String {
+		count, err := dbGetUserCountByEmail(db, confirm.Email.String)
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			return errors.New(ERROR_EMAILTAKEN)
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = dbTxUpdateUserEmailVerified(tx, user.GetID(), confirm.Email.String)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxDeleteUserConfirmation(tx, selector)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ConfirmEmailWithCode verifies the address of a user registered with
+// RegisterWithConfirmation in CONFIRMATION_CODE mode.
+func ConfirmEmailWithCode(db *sqlx.DB, email string, code string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	user, err := getConfirmableUserByEmail(db, email)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDCODE)
+		}
+		return err
+	}
+
+	if user.IsVerified() {
+		return errors.New(ERROR_ALREADYVERIFIED)
+	}
+
+	c, err := checkCode(db, user.GetID(), CODE_CONFIRM, code)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = txConsumeCode(tx, c)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxUpdateUserEmailVerified(tx, user.GetID(), c.Recipient.String)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+func RequestEmailChange(db *sqlx.DB, userID int64, newEmail string, password string, confirmEmail SelectorTokenCallBack, notifyOldEmail SelectorTokenCallBack) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	if !validateEmail(newEmail) {
+		return errors.New(ERROR_INVALIDEMAIL)
+	}
+
+	if err := checkRegistrationEmail(newEmail); err != nil {
+		return err
+	}
+
+	user, err := dbGetUserByID(db, userID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	if !verifyHash(user.Password.String, password) {
+		return errors.New(ERROR_INVALIDPASSWORD)
+	}
+
+	count, err := dbGetUserCountByEmail(db, newEmail)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return errors.New(ERROR_EMAILTAKEN)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	// only the most recent change request may be confirmed
+	err = dbTxDeleteUserConfirmationAllByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	confirm := NewUserConfirmation(user.GetID(), newEmail, getUserConfirmationExpiry())
+
+	_, err = dbTxCreateUserConfirmation(tx, confirm)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	revert := NewUserEmailRevert(user.GetID(), user.Email.String, getUserEmailRevertExpiry())
+
+	_, err = dbTxCreateUserEmailRevert(tx, revert)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	revertQueued, err := txQueueCallBack(tx, notifyOldEmail, revert.GetSelector(), revert.GetToken())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	confirmQueued, err := txQueueCallBack(tx, confirmEmail, confirm.GetSelector(), confirm.GetToken())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	// the old address is told first, the change must not go ahead without
+	// the revert link
+	if !revertQueued {
+		err = notifyOldEmail(revert.GetSelector(), revert.GetToken())
+	}
+	if err == nil && !confirmQueued {
+		err = confirmEmail(confirm.GetSelector(), confirm.GetToken())
+	}
+	if err != nil {
+		_ = dbDeleteUserConfirmation(db, confirm.GetSelector())
+		_ = dbDeleteUserEmailRevert(db, revert.GetSelector())
+		return err
+	}
+
+	return nil
+}
+func RevertEmailChange(db *sqlx.DB, selector string, token string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	revert, err := dbGetUserEmailRevertBySelector(db, selector)
+	if err != nil {
+		return err
+	}
+
+	if !verifyHash(revert.Token.String, token) {
+		return errors.New(ERROR_INVALIDTOKEN)
+	}
+
+	if revert.HasExpired() {
+		return errors.New(ERROR_TOKENEXPIRED)
+	}
+
+	user, err := dbGetUserByID(db, revert.UserID.Int64)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	if emailKey(revert.Email.String) != user.EmailKey.String {
+		count, err := dbGetUserCountByEmail(db, revert.Email.String)
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			return errors.New(ERROR_EMAILTAKEN)
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = dbTxUpdateUserEmailVerified(tx, user.GetID(), revert.Email.String)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// drop pending changes and existing logins, the account may be compromised
+	err = dbTxDeleteUserConfirmationAllByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxDeleteUserEmailRevertAllByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxDeleteAllUserRememberedByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+func Login(db *sqlx.DB, email string, password string) (int64, error) {
+	if err := checkDatabase(db); err != nil {
+		return -999, err
+	}
+
+	if !validateEmail(email) {
+		return -999, errors.New(ERROR_INVALIDEMAIL)
+	}
+
+	user, err := dbGetUserByEmail(db, email)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		user, err = getInactiveUserByEmail(db, email)
+	}
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			if isEnumerationSafe() {
+				_ = verifyHash(getDummyHash(), password)
+				return -999, errors.New(ERROR_INVALIDLOGIN)
+			}
+			return -999, errors.New(ERROR_INVALIDEMAIL)
+		}
+
+		return -999, err
+	}
+
+	validPassword := verifyHash(user.Password.String, password)
+
+	// account state is only revealed to someone who knows the password
+	if isEnumerationSafe() && !validPassword {
+		return -999, errors.New(ERROR_INVALIDLOGIN)
+	}
+
+	if !validPassword {
+		return -999, errors.New(ERROR_INVALIDPASSWORD)
+	}
+
+	return completeLogin(db, user)
+}
+
+// LoginWithIdentifier is Login for an email address or a username.
+func LoginWithIdentifier(db *sqlx.DB, identifier string, password string) (int64, error) {
+	if err := checkDatabase(db); err != nil {
+		return -999, err
+	}
+
+	identifier = strings.TrimSpace(identifier)
+	if strings.Contains(identifier, "@") {
+		return Login(db, identifier, password)
+	}
+
+	user, err := dbGetUserByUsername(db, identifier)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			if isEnumerationSafe() {
+				_ = verifyHash(getDummyHash(), password)
+				return -999, errors.New(ERROR_INVALIDLOGIN)
+			}
+			return -999, errors.New(ERROR_INVALIDUSERNAME)
+		}
+
+		return -999, err
+	}
+
+	return Login(db, user.Email.String, password)
+}
+
+// RequestLoginLink emails a link that signs the user in without a password.
+// Only the newest link works, and only once.
+func RequestLoginLink(db *sqlx.DB, email string, sendLink SelectorTokenCallBack) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	if !validateEmail(email) {
+		return errors.New(ERROR_INVALIDEMAIL)
+	}
+
+	user, err := dbGetUserByEmail(db, email)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		user, err = getInactiveUserByEmail(db, email)
+	}
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return concealUnknownAccount(errors.New(ERROR_INVALIDEMAIL))
+		}
+		return err
+	}
+
+	if err := checkLoginStatus(user); err != nil {
+		return concealAccountError(email, NOTICE_LOGIN_UNAVAILABLE, err)
+	}
+
+	link := NewUserLoginLink(user.GetID(), getUserLoginLinkExpiry())
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = dbTxDeleteUserLoginLinkByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = dbTxCreateUserLoginLink(tx, link)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	queued, err := txQueueCallBack(tx, sendLink, link.GetSelector(), link.GetToken())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if queued {
+		return nil
+	}
+
+	err = sendLink(link.GetSelector(), link.GetToken())
+	if err != nil {
+		_ = dbDeleteUserLoginLink(db, link.GetSelector())
+		return err
+	}
+
+	return nil
+}
+
+// ConsumeLoginLink returns the ID of the user the link was sent to. Since
+// the link proves ownership of the address, an unverified address becomes
+// verified. The account checks of Login still apply, so it may return a
+// SecondFactorError or ERROR_PASSWORDCHANGE instead.
+func ConsumeLoginLink(db *sqlx.DB, selector string, token string) (int64, error) {
+	if err := checkDatabase(db); err != nil {
+		return -999, err
+	}
+
+	link, err := dbGetUserLoginLinkBySelector(db, selector)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return -999, errors.New(ERROR_INVALIDSELECTOR)
+		}
+		return -999, err
+	}
+
+	if !verifyHash(link.Token.String, token) {
+		return -999, errors.New(ERROR_INVALIDTOKEN)
+	}
+
+	if link.HasExpired() {
+		return -999, errors.New(ERROR_TOKENEXPIRED)
+	}
+
+	user, err := dbGetUserByID(db, link.UserID.Int64)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		user, err = getInactiveUserByID(db, link.UserID.Int64)
+	}
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return -999, errors.New(ERROR_INVALIDUSERID)
+		}
+		return -999, err
+	}
+
+	// the link is kept for when the account can sign in again
+	if err := checkLoginStatus(user); err != nil {
+		return -999, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return -999, err
+	}
+
+	deleted, err := dbTxDeleteUserLoginLink(tx, selector)
+	if err != nil {
+		_ = tx.Rollback()
+		return -999, err
+	}
+
+	// someone else used the link first
+	if deleted != 1 {
+		_ = tx.Rollback()
+		return -999, errors.New(ERROR_INVALIDSELECTOR)
+	}
+
+	err = dbTxUpdateUserVerified(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return -999, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return -999, err
+	}
+	user.SetVerified(true)
+
+	return completeLogin(db, user)
+}
+
+// RequestLoginCode emails a one-time code that ConsumeLoginCode exchanges
+// for the user ID, the code alternative to RequestLoginLink.
+func RequestLoginCode(db *sqlx.DB, email string, sendCode CodeCallBack) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	if !validateEmail(email) {
+		return errors.New(ERROR_INVALIDEMAIL)
+	}
+
+	user, err := dbGetUserByEmail(db, email)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		user, err = getInactiveUserByEmail(db, email)
+	}
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return concealUnknownAccount(errors.New(ERROR_INVALIDEMAIL))
+		}
+		return err
+	}
+
+	if err := checkLoginStatus(user); err != nil {
+		return concealAccountError(email, NOTICE_LOGIN_UNAVAILABLE, err)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	code, err := txIssueCode(tx, user.GetID(), CODE_LOGIN, email)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	queued, err := txQueueCodeCallBack(tx, sendCode, code.GetCode())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if queued {
+		return nil
+	}
+
+	err = sendCode(code.GetCode())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ConsumeLoginCode returns the ID of the user the code was sent to and, like
+// ConsumeLoginLink, verifies an unverified address.
+func ConsumeLoginCode(db *sqlx.DB, email string, code string) (int64, error) {
+	if err := checkDatabase(db); err != nil {
+		return -999, err
+	}
+
+	user, err := dbGetUserByEmail(db, email)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		user, err = getInactiveUserByEmail(db, email)
+	}
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return -999, errors.New(ERROR_INVALIDCODE)
+		}
+		return -999, err
+	}
+
+	c, err := checkCode(db, user.GetID(), CODE_LOGIN, code)
+	if err != nil {
+		return -999, err
+	}
+
+	// in enumeration-safe mode a blocked account is never sent a code, so
+	// one issued before the block must look like any other invalid code
+	if err := checkLoginStatus(user); err != nil {
+		if isEnumerationSafe() {
+			return -999, errors.New(ERROR_INVALIDCODE)
+		}
+		return -999, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return -999, err
+	}
+
+	err = txConsumeCode(tx, c)
+	if err != nil {
+		_ = tx.Rollback()
+		return -999, err
+	}
+
+	err = dbTxUpdateUserVerified(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return -999, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return -999, err
+	}
+	user.SetVerified(true)
+
+	return completeLogin(db, user)
+}
+func Remember(db *sqlx.DB, userID int64, expires int64, setCookie SelectorTokenCallBack) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	remember := NewUserRemember(userID, expires)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	_, err = dbTxCreateUserRemember(tx, remember)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	err = setCookie(remember.GetSelector(), remember.GetToken())
+	if err != nil {
+		_ = dbDeleteUserRemember(db, remember.GetSelector())
+		return err
+	}
+
+	return nil
+}
+func DeleteRemember(db *sqlx.DB, selector string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	err := dbDeleteUserRemember(db, selector)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+func ConfirmRemember(db *sqlx.DB, selector string, token string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	remember, err := dbGetUserRememberBySelector(db, selector)
+	if err != nil {
+		return err
+	}
+
+	if !verifyHash(remember.Token.String, token) {
+
+		err = dbDeleteUserRemember(db, selector)
+		if err != nil {
+			return err
+		}
+
+		return errors.New(ERROR_INVALIDTOKEN)
+	}
+
+	if remember.HasExpired() {
+
+		err = dbDeleteUserRemember(db, selector)
+		if err != nil {
+			return err
+		}
+
+		return errors.New(ERROR_TOKENEXPIRED)
+	}
+
+	return nil
+}
+func ResetPasswordWithConfirmation(db *sqlx.DB, email string, confirmEmail SelectorTokenCallBack) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	if !validateEmail(email) {
+		return errors.New(ERROR_INVALIDEMAIL)
+	}
+
+	user, err := dbGetUserByEmail(db, email)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return concealUnknownAccount(errors.New(ERROR_INVALIDEMAIL))
+		}
+		return err
+	}
+
+	if !user.IsVerified() {
+		return concealAccountError(email, NOTICE_RESET_UNAVAILABLE, errors.New(ERROR_EMAILNOTVERIFIED))
+	}
+
+	if !user.IsResettable() {
+		return concealAccountError(email, NOTICE_RESET_UNAVAILABLE, errors.New(ERROR_RESETDISABLED))
+	}
+
+	resetCount, err := dbGetUserResetCount(db, user.GetID())
+	if err != nil {
+		return err
+	}
+
+	if resetCount >= getMaxUserResetRequests() {
+		return concealAccountError(email, NOTICE_RESET_UNAVAILABLE, errors.New(ERROR_TOOMANYREQUESTS))
+	}
+
+	reset := NewUserReset(user.GetID(), getUserResetExpiry())
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	_, err = dbTxCreateUserReset(tx, reset)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	queued, err := txQueueCallBack(tx, confirmEmail, reset.GetSelector(), reset.GetToken())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if queued {
+		return nil
+	}
+
+	err = confirmEmail(reset.GetSelector(), reset.GetToken())
+	if err != nil {
+		// a reset that was never sent must not count against the limit
+		_ = dbDeleteUserReset(db, reset.GetSelector())
+		return err
+	}
+
+	return nil
+}
+func ConfirmReset(db *sqlx.DB, selector string, token string) (int64, error) {
+	if err := checkDatabase(db); err != nil {
+		return -999, err
+	}
+
+	reset, err := dbGetUserResetBySelector(db, selector)
+	if err != nil {
+		return -999, err
+	}
+
+	if !verifyHash(reset.Token.String, token) {
+		return -999, errors.New(ERROR_INVALIDTOKEN)
+	}
+
+	if reset.HasExpired() {
+		return -999, errors.New(ERROR_TOKENEXPIRED)
+	}
+
+	return reset.UserID.Int64, nil
+}
+
+// CompleteReset verifies a reset link and sets the new password. Every reset
+// link and remember token of the user is deleted in the same transaction,
+// so the link cannot be used again.
+func CompleteReset(db *sqlx.DB, selector string, token string, password string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	reset, err := dbGetUserResetBySelector(db, selector)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDSELECTOR)
+		}
+		return err
+	}
+
+	if !verifyHash(reset.Token.String, token) {
+		return errors.New(ERROR_INVALIDTOKEN)
+	}
+
+	if reset.HasExpired() {
+		return errors.New(ERROR_TOKENEXPIRED)
+	}
+
+	user, err := dbGetUserByIDNotArchived(db, reset.UserID.Int64)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	// a link sent before the account was blocked must not unlock it
+	if user.Status.Int64 != STATUS_NORMAL {
+		return errors.New(ERROR_USERBLOCKED)
+	}
+
+	if !user.IsVerified() {
+		return errors.New(ERROR_EMAILNOTVERIFIED)
+	}
+
+	if !user.IsResettable() {
+		return errors.New(ERROR_RESETDISABLED)
+	}
+
+	// a rejected password leaves the link valid for another attempt
+	if err := checkNewPassword(db, user, password); err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = txSetUserPassword(tx, user, password, false)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxDeleteUserResetByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxDeleteAllUserRememberedByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RequestResetCode emails a one-time code for CompleteResetWithCode, the
+// code alternative to ResetPasswordWithConfirmation.
+func RequestResetCode(db *sqlx.DB, email string, sendCode CodeCallBack) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	if !validateEmail(email) {
+		return errors.New(ERROR_INVALIDEMAIL)
+	}
+
+	user, err := dbGetUserByEmail(db, email)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return concealUnknownAccount(errors.New(ERROR_INVALIDEMAIL))
+		}
+		return err
+	}
+
+	if !user.IsVerified() {
+		return concealAccountError(email, NOTICE_RESET_UNAVAILABLE, errors.New(ERROR_EMAILNOTVERIFIED))
+	}
+
+	if !user.IsResettable() {
+		return concealAccountError(email, NOTICE_RESET_UNAVAILABLE, errors.New(ERROR_RESETDISABLED))
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	code, err := txIssueCode(tx, user.GetID(), CODE_RESET, email)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	queued, err := txQueueCodeCallBack(tx, sendCode, code.GetCode())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if queued {
+		return nil
+	}
+
+	err = sendCode(code.GetCode())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CompleteResetWithCode is CompleteReset for a code from RequestResetCode.
+func CompleteResetWithCode(db *sqlx.DB, email string, code string, password string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	user, err := dbGetUserByEmail(db, email)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDCODE)
+		}
+		return err
+	}
+
+	if !user.IsVerified() {
+		return errors.New(ERROR_EMAILNOTVERIFIED)
+	}
+
+	if !user.IsResettable() {
+		return errors.New(ERROR_RESETDISABLED)
+	}
+
+	c, err := checkCode(db, user.GetID(), CODE_RESET, code)
+	if err != nil {
+		return err
+	}
+
+	// a rejected password leaves the code valid for another attempt
+	if err := checkNewPassword(db, user, password); err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = txConsumeCode(tx, c)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = txSetUserPassword(tx, user, password, false)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxDeleteUserResetByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxDeleteAllUserRememberedByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+func DeleteReset(db *sqlx.DB, selector string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	err := dbDeleteUserReset(db, selector)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+func ResetPassword(db *sqlx.DB, email string, password string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	user, err := dbGetUserByEmail(db, email)
+	if err != nil {
+		return err
+	}
+
+	if !user.IsVerified() {
+		return errors.New(ERROR_EMAILNOTVERIFIED)
+	}
+
+	if !user.IsResettable() {
+		return errors.New(ERROR_RESETDISABLED)
+	}
+
+	if !user.Status.Valid && user.Status.Int64 != STATUS_NORMAL {
+		return errors.New(ERROR_USERBLOCKED)
+	}
+
+	return setUserPassword(db, user, password)
+}
+func ResetPasswordWithID(db *sqlx.DB, userID int64, password string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	user, err := dbGetUserByID(db, userID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	if !user.IsVerified() {
+		return errors.New(ERROR_EMAILNOTVERIFIED)
+	}
+
+	if !user.IsResettable() {
+		return errors.New(ERROR_RESETDISABLED)
+	}
+
+	if !user.Status.Valid && user.Status.Int64 != STATUS_NORMAL {
+		return errors.New(ERROR_USERBLOCKED)
+	}
+
+	return setUserPassword(db, user, password)
+}
+
+// ChangePassword replaces the password of a logged in user. Every remember
+// token is deleted, the caller's included, and force_logout is incremented
+// so sessions that stored the previous value should be ended. The caller
+// keeps its own session by storing the new force_logout value and calling
+// Remember again.
+func ChangePassword(db *sqlx.DB, userID int64, oldPassword string, newPassword string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	user, err := dbGetUserByID(db, userID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	if !verifyHash(user.Password.String, oldPassword) {
+		return errors.New(ERROR_INVALIDPASSWORD)
+	}
+
+	if err := checkPasswordAge(user); err != nil {
+		return err
+	}
+
+	if err := checkNewPassword(db, user, newPassword); err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = txSetUserPassword(tx, user, newPassword, false)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxIncrementUserForceLogout(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxDeleteAllUserRememberedByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = txEmitAuditEvent(tx, user.GetID(), AUDIT_PASSWORD_CHANGED)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	notifyAuditEvent(user.GetID(), AUDIT_PASSWORD_CHANGED)
+	return nil
+}
+
+// SetTemporaryPassword sets a password the user must change at the next
+// login. Remember tokens are deleted and force_logout is incremented, so
+// sessions already signed in should be ended.
+func SetTemporaryPassword(db *sqlx.DB, userID int64, password string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	user, err := dbGetUserByID(db, userID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	if err := checkPassword(password, user.Email.String); err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = txSetUserPassword(tx, user, password, true)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxIncrementUserForceLogout(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxDeleteAllUserRememberedByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+func GetUserLocale(db *sqlx.DB, userID int64) (string, error) {
+	if err := checkDatabase(db); err != nil {
+		return "", err
+	}
+
+	user, err := dbGetUserByID(db, userID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return "", errors.New(ERROR_INVALIDUSERID)
+		}
+		return "", err
+	}
+
+	return user.GetLocale(), nil
+}
+func SetUserLocale(db *sqlx.DB, userID int64, locale string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	err := dbUpdateUser(
+		db,
+		userID,
+		database.NewFieldValuePairCollection(
+			database.NewFieldValuePair("locale", normalizeLocale(locale)),
+		),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ChangeUsername sets or changes the username of a user. The previous name
+// is reserved for the user as configured by SetUsernamePolicy, so it can be
+// taken back but not by anyone else.
+func ChangeUsername(db *sqlx.DB, userID int64, username string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	username = strings.TrimSpace(username)
+	if !validUsername(username) {
+		return errors.New(ERROR_INVALIDUSERNAME)
+	}
+
+	user, err := dbGetUserByID(db, userID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	key := usernameKey(username)
+	oldKey := ""
+	if user.UsernameKey != nil && user.UsernameKey.Valid {
+		oldKey = user.UsernameKey.String
+	}
+
+	// a change of case only keeps the name
+	if key != oldKey {
+		count, err := dbGetUserCountByUsername(db, username)
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			return errors.New(ERROR_USERNAMETAKEN)
+		}
+
+		reservation, err := dbGetUserUsernameReservation(db, key, time.Now().Unix())
+		if err != nil && err.Error() != "sql: no rows in result set" {
+			return err
+		}
+
+		if err == nil && reservation.UserID.Int64 != user.GetID() {
+			return errors.New(ERROR_USERNAMETAKEN)
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if key != oldKey {
+		// the user's own reservation or an expired one
+		err = dbTxDeleteUserUsernameReservation(tx, key)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if oldKey != "" {
+			expires := int64(0)
+			if policy := getUsernamePolicy(); policy != nil && policy.Reservation > 0 {
+				expires = time.Now().Add(policy.Reservation).Unix()
+			}
+
+			_, err = dbTxCreateUserUsernameReservation(tx, user.GetID(), oldKey, expires)
+			if err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	err = dbTxUpdateUserUsername(tx, user.GetID(), username)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RequestPhoneVerification texts a code to phone that ConfirmPhone exchanges
+// for a verified phone number on the account.
+func RequestPhoneVerification(db *sqlx.DB, userID int64, phone string, sms SMSSender) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	if !validatePhone(phone) {
+		return errors.New(ERROR_INVALIDPHONE)
+	}
+
+	user, err := dbGetUserByID(db, userID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	if user.IsPhoneVerified() && user.Phone.String == phone {
+		return errors.New(ERROR_ALREADYVERIFIED)
+	}
+
+	count, err := dbGetUserCountByPhone(db, phone)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return errors.New(ERROR_PHONETAKEN)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	code, err := txIssueCode(tx, user.GetID(), CODE_PHONE_VERIFY, phone)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	err = sendSMSCode(sms, phone, user.GetLocale(), code.GetCode())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+func ConfirmPhone(db *sqlx.DB, userID int64, code string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	c, err := checkCode(db, userID, CODE_PHONE_VERIFY, code)
+	if err != nil {
+		return err
+	}
+
+	// the number may have been verified by someone else in the meantime
+	count, err := dbGetUserCountByPhone(db, c.Recipient.String)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return errors.New(ERROR_PHONETAKEN)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = txConsumeCode(tx, c)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = dbTxUpdateUserPhoneVerified(tx, userID, c.Recipient.String)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetPhoneTwoFactor turns the SMS second factor on or off. While it is on,
+// Login returns a SecondFactorError, and the login is finished with
+// RequestSecondFactor and VerifySecondFactor. Turning it off takes the
+// current password; it is ignored when turning it on.
+func SetPhoneTwoFactor(db *sqlx.DB, userID int64, enabled bool, password string) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	user, err := dbGetUserByID(db, userID)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	if enabled && !user.IsPhoneVerified() {
+		return errors.New(ERROR_PHONENOTVERIFIED)
+	}
+
+	if !enabled && !verifyHash(user.Password.String, password) {
+		return errors.New(ERROR_INVALIDPASSWORD)
+	}
+
+	value := 0
+	if enabled {
+		value = 1
+	}
+
+	err = dbUpdateUser(
+		db,
+		user.GetID(),
+		database.NewFieldValuePairCollection(
+			database.NewFieldValuePair("phone_two_factor", value),
+		),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RequestSecondFactor texts a code to the user of the SecondFactorError
+// that Login returned.
+func RequestSecondFactor(db *sqlx.DB, selector string, token string, sms SMSSender) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	challenge, err := getUserChallenge(db, selector, token)
+	if err != nil {
+		return err
+	}
+
+	user, err := dbGetUserByID(db, challenge.UserID.Int64)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
+		return err
+	}
+
+	if !user.IsPhoneVerified() {
+		return errors.New(ERROR_PHONENOTVERIFIED)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	// attempts are counted per user, so new challenges bring no new guesses
+	code, err := txIssueCode(tx, user.GetID(), CODE_SECOND_FACTOR, user.Phone.String)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	err = sendSMSCode(sms, user.Phone.String, user.GetLocale(), code.GetCode())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// VerifySecondFactor finishes a Login that returned a SecondFactorError and
+// returns the user ID. Like Login it returns ERROR_PASSWORDCHANGE together
+// with the ID if the password must be changed.
+func VerifySecondFactor(db *sqlx.DB, selector string, token string, code string) (int64, error) {
+	if err := checkDatabase(db); err != nil {
+		return -999, err
+	}
+
+	challenge, err := getUserChallenge(db, selector, token)
+	if err != nil {
+		return -999, err
+	}
+
+	user, err := dbGetUserByID(db, challenge.UserID.Int64)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return -999, errors.New(ERROR_INVALIDUSERID)
+		}
+		return -999, err
+	}
+
+	c, err := checkCode(db, user.GetID(), CODE_SECOND_FACTOR, code)
+	if err != nil {
+		return -999, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return -999, err
+	}
+
+	err = txConsumeCode(tx, c)
+	if err != nil {
+		_ = tx.Rollback()
+		return -999, err
+	}
+
+	deleted, err := dbTxDeleteUserChallenge(tx, selector)
+	if err != nil {
+		_ = tx.Rollback()
+		return -999, err
+	}
+
+	// someone else completed the challenge first
+	if deleted != 1 {
+		_ = tx.Rollback()
+		return -999, errors.New(ERROR_INVALIDSELECTOR)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return -999, err
+	}
+
+	return finishLogin(db, user)
+}
+
+// RequestPhoneRecovery texts a code to a verified phone number for
+// CompletePhoneRecovery, for users who lost access to their email.
+func RequestPhoneRecovery(db *sqlx.DB, phone string, sms SMSSender) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	if !validatePhone(phone) {
+		return errors.New(ERROR_INVALIDPHONE)
+	}
+
+	user, err := dbGetUserByPhone(db, phone)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return concealUnknownAccount(errors.New(ERROR_INVALIDPHONE))
+		}
+		return err
+	}
+
+	if !user.IsResettable() {
+		return concealAccountError(user.Email.String, NOTICE_RESET_UNAVAILABLE, errors.New(ERROR_RESETDISABLED))
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	code, err := txIssueCode(tx, user.GetID(), CODE_PHONE_RECOVERY, phone)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
 
-	id, err := dbCreateUser(db, user)
+	err = tx.Commit()
 	if err != nil {
 		return err
 	}
 
-	err = dbUpdateUser(
-		db,
-		id,
-		database.NewFieldValuePairCollection(
-			database.NewFieldValuePair("verified", 1),
-		),
-	)
+	err = sendSMSCode(sms, phone, user.GetLocale(), code.GetCode())
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
-func RegisterWithConfirmation(db *sqlx.DB, email string, password string, confirmEmail SelectorTokenCallBack) error {
+
+// CompletePhoneRecovery sets a new password with a code from
+// RequestPhoneRecovery and signs out every remembered session.
+func CompletePhoneRecovery(db *sqlx.DB, phone string, code string, password string) error {
 	if err := checkDatabase(db); err != nil {
 		return err
 	}
 
-	if !validateEmail(email) {
-		return errors.New(ERROR_INVALIDEMAIL)
+	user, err := dbGetUserByPhone(db, phone)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDCODE)
+		}
+		return err
 	}
 
-	user := NewUser(email, hashPassword(password), time.Now().Unix())
+	if !user.IsResettable() {
+		return errors.New(ERROR_RESETDISABLED)
+	}
 
-	id, err := dbCreateUser(db, user)
+	c, err := checkCode(db, user.GetID(), CODE_PHONE_RECOVERY, code)
 	if err != nil {
 		return err
 	}
 
-	confirm := NewUserConfirmation(id, email, getUserConfirmationExpiry())
-
-	_, err = dbCreateUserConfirmation(db, confirm)
-	if err != nil {
+	// a rejected password leaves the code valid for another attempt
+	if err := checkNewPassword(db, user, password); err != nil {
 		return err
 	}
 
-	err = confirmEmail(confirm.GetSelector(), confirm.GetToken())
+	tx, err := db.Beginx()
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
-func ConfirmEmail(db *sqlx.DB, selector string, token string) error {
-	if err := checkDatabase(db); err != nil {
+	err = txConsumeCode(tx, c)
+	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
 
-	confirm, err := dbGetUserConfirmationBySelector(db, selector)
+	err = txSetUserPassword(tx, user, password, false)
 	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
 
-	if !verifyHash(confirm.Token.String, token) {
-		return errors.New(ERROR_INVALIDTOKEN)
+	err = dbTxDeleteUserResetByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
 	}
 
-	if confirm.HasExpired() {
-		return errors.New(ERROR_TOKENEXPIRED)
+	err = dbTxDeleteAllUserRememberedByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
 	}
 
-	user, err := dbGetUserByID(db, confirm.UserID.Int64)
+	err = tx.Commit()
 	if err != nil {
-		if err.Error() == "sql: no rows in result set" {
-			return errors.New(ERROR_INVALIDUSERID)
-		}
 		return err
 	}
 
-	err = dbUpdateUser(
-		db,
-		user.GetID(),
-		database.NewFieldValuePairCollection(
-			database.NewFieldValuePair("email", confirm.Email.String),
-			database.NewFieldValuePair("verified", 1),
-		),
-	)
-	if err != nil {
+	return nil
+}
+func ReconfirmPassword(db *sqlx.DB, email string, password string) error {
+	if err := checkDatabase(db); err != nil {
 		return err
 	}
 
-	err = dbDeleteUserConfirmation(db, selector)
+	user, err := dbGetUserByEmail(db, email)
 	if err != nil {
 		return err
 	}
 
+	if !verifyHash(user.Password.String, password) {
+		return errors.New(ERROR_INVALIDPASSWORD)
+	}
+
 	return nil
 }
-func Login(db *sqlx.DB, email string, password string) (int64, error) {
-	if err := checkDatabase(db); err != nil {
-		return -999, err
+
+// getInactiveUserByEmail finds an account that is not STATUS_NORMAL for
+// the ways of signing in, reinstating it first if its suspension has ended.
+func getInactiveUserByEmail(db *sqlx.DB, email string) (*User, error) {
+	user, err := dbGetUserByEmailNotArchived(db, email)
+	if err != nil {
+		return nil, err
+	}
+	return user, liftEndedSuspension(db, user)
+}
+func getInactiveUserByID(db *sqlx.DB, userID int64) (*User, error) {
+	user, err := dbGetUserByIDNotArchived(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	return user, liftEndedSuspension(db, user)
+}
+func liftEndedSuspension(db *sqlx.DB, user *User) error {
+	if !user.IsSuspensionOver() {
+		return nil
 	}
 
-	if !validateEmail(email) {
-		return -999, errors.New(ERROR_INVALIDEMAIL)
+	err := reinstateUser(db, user, "suspension ended", 0)
+	if err != nil {
+		// banned meanwhile, the account stays blocked for this login
+		if err.Error() == ERROR_STATUSCHANGED {
+			return nil
+		}
+		return err
 	}
+	user.SetStatus(STATUS_NORMAL)
+	return nil
+}
 
-	user, err := dbGetUserByEmail(db, email)
+// getUserChallenge returns the challenge of a SecondFactorError if its
+// token matches and it has not expired.
+func getUserChallenge(db *sqlx.DB, selector string, token string) (*UserChallenge, error) {
+	challenge, err := dbGetUserChallengeBySelector(db, selector)
 	if err != nil {
 		if err.Error() == "sql: no rows in result set" {
-			return -999, errors.New(ERROR_INVALIDEMAIL)
+			return nil, errors.New(ERROR_INVALIDSELECTOR)
 		}
+		return nil, err
+	}
+
+	if !verifyHash(challenge.Token.String, token) {
+		return nil, errors.New(ERROR_INVALIDTOKEN)
+	}
+
+	if challenge.HasExpired() {
+		return nil, errors.New(ERROR_TOKENEXPIRED)
+	}
+
+	return challenge, nil
+}
 
+// completeLogin runs the checks that Login, ConsumeLoginLink and
+// ConsumeLoginCode share once the user has proven who they are, so no way
+// of signing in skips one, and records the login.
+func completeLogin(db *sqlx.DB, user *User) (int64, error) {
+	if err := checkLoginStatus(user); err != nil {
 		return -999, err
 	}
 
@@ -133,15 +2523,37 @@ func Login(db *sqlx.DB, email string, password string) (int64, error) {
 		return -999, errors.New(ERROR_EMAILNOTVERIFIED)
 	}
 
-	if user.Status.Int64 != STATUS_NORMAL {
-		return -999, errors.New(ERROR_USERBLOCKED)
+	// the login is finished by VerifySecondFactor
+	if user.IsPhoneTwoFactorEnabled() {
+		challenge := NewUserChallenge(user.GetID(), getUserChallengeExpiry())
+		_, err := dbCreateUserChallenge(db, challenge)
+		if err != nil {
+			return -999, err
+		}
+		return -999, &SecondFactorError{Selector: challenge.GetSelector(), Token: challenge.GetToken()}
 	}
 
-	if !verifyHash(user.Password.String, password) {
-		return -999, errors.New(ERROR_INVALIDPASSWORD)
+	return finishLogin(db, user)
+}
+
+// checkLoginStatus returns why an account that is not STATUS_NORMAL cannot
+// sign in.
+func checkLoginStatus(user *User) error {
+	switch user.Status.Int64 {
+	case STATUS_NORMAL:
+		return nil
+	case STATUS_PENDING_REVIEW:
+		return errors.New(ERROR_PENDINGREVIEW)
+	case STATUS_SUSPENDED:
+		return errors.New(ERROR_USERSUSPENDED)
+	default:
+		return errors.New(ERROR_USERBLOCKED)
 	}
+}
 
-	err = dbUpdateUser(
+// finishLogin records the login and demands a password change if one is due.
+func finishLogin(db *sqlx.DB, user *User) (int64, error) {
+	err := dbUpdateUser(
 		db,
 		user.GetID(),
 		database.NewFieldValuePairCollection(
@@ -152,234 +2564,237 @@ func Login(db *sqlx.DB, email string, password string) (int64, error) {
 		return -999, err
 	}
 
+	// the ID is returned so the caller can send the user to a change
+	// password form, but the error keeps them from being logged in
+	if user.IsPasswordChangeRequired() || user.HasPasswordExpired(getPasswordExpiry()) {
+		return user.GetID(), errors.New(ERROR_PASSWORDCHANGE)
+	}
+
 	return user.GetID(), nil
 }
-func Remember(db *sqlx.DB, userID int64, expires int64, setCookie SelectorTokenCallBack) error {
+func blockUser(db *sqlx.DB, userID int64, status int64, until int64, reason string, actorID int64, event string) error {
 	if err := checkDatabase(db); err != nil {
 		return err
 	}
 
-	remember := NewUserRemember(userID, expires)
-
-	_, err := dbCreateUserRemember(db, remember)
+	user, err := dbGetUserByIDNotArchived(db, userID)
 	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_INVALIDUSERID)
+		}
 		return err
 	}
 
-	err = setCookie(remember.GetSelector(), remember.GetToken())
-	if err != nil {
-		return err
+	// reinstating sets STATUS_NORMAL, so accounts pending review or locked
+	// in any other way must not be blocked
+	switch user.Status.Int64 {
+	case STATUS_NORMAL, STATUS_SUSPENDED:
+	case STATUS_BANNED:
+		if status != STATUS_BANNED {
+			return errors.New(ERROR_INVALIDSTATUS)
+		}
+	default:
+		return errors.New(ERROR_INVALIDSTATUS)
 	}
 
-	return nil
-}
-func DeleteRemember(db *sqlx.DB, selector string) error {
-	if err := checkDatabase(db); err != nil {
+	tx, err := db.Beginx()
+	if err != nil {
 		return err
 	}
 
-	err := dbDeleteUserRemember(db, selector)
+	err = txChangeUserStatus(tx, user, NewUserStatusChange(user.GetID(), status, reason, actorID, until))
 	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
-	return nil
-}
-func ConfirmRemember(db *sqlx.DB, selector string, token string) error {
-	if err := checkDatabase(db); err != nil {
+
+	err = dbTxDeleteAllUserRememberedByUserID(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
 
-	remember, err := dbGetUserRememberBySelector(db, selector)
+	err = dbTxIncrementUserForceLogout(tx, user.GetID())
 	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
 
-	if !verifyHash(remember.Token.String, token) {
-
-		err = dbDeleteUserRemember(db, selector)
-		if err != nil {
-			return err
-		}
-
-		return errors.New(ERROR_INVALIDTOKEN)
+	err = txEmitAuditEvent(tx, user.GetID(), event)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
 	}
 
-	if remember.HasExpired() {
-
-		err = dbDeleteUserRemember(db, selector)
-		if err != nil {
-			return err
-		}
-
-		return errors.New(ERROR_TOKENEXPIRED)
+	err = tx.Commit()
+	if err != nil {
+		return err
 	}
 
+	notifyAuditEvent(user.GetID(), event)
 	return nil
 }
-func ResetPasswordWithConfirmation(db *sqlx.DB, email string, confirmEmail SelectorTokenCallBack) error {
-	if err := checkDatabase(db); err != nil {
-		return err
-	}
-
-	if !validateEmail(email) {
-		return errors.New(ERROR_INVALIDEMAIL)
-	}
-
-	user, err := dbGetUserByEmail(db, email)
+func reinstateUser(db *sqlx.DB, user *User, reason string, actorID int64) error {
+	tx, err := db.Beginx()
 	if err != nil {
-		if err.Error() == "sql: no rows in result set" {
-			return errors.New(ERROR_INVALIDEMAIL)
-		}
 		return err
 	}
 
-	if !user.IsVerified() {
-		return errors.New(ERROR_EMAILNOTVERIFIED)
-	}
-
-	if !user.IsResettable() {
-		return errors.New(ERROR_RESETDISABLED)
-	}
-
-	resetCount, err := dbGetUserResetCount(db, user.GetID())
+	err = txChangeUserStatus(tx, user, NewUserStatusChange(user.GetID(), STATUS_NORMAL, reason, actorID, 0))
 	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
 
-	if resetCount >= getMaxUserResetRequests() {
-		return errors.New(ERROR_TOOMANYREQUESTS)
-	}
-
-	reset := NewUserReset(user.GetID(), getUserResetExpiry())
-
-	_, err = dbCreateUserReset(db, reset)
+	err = txEmitAuditEvent(tx, user.GetID(), AUDIT_USER_REINSTATED)
 	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
 
-	err = confirmEmail(reset.GetSelector(), reset.GetToken())
+	err = tx.Commit()
 	if err != nil {
 		return err
 	}
 
+	notifyAuditEvent(user.GetID(), AUDIT_USER_REINSTATED)
 	return nil
 }
-func ConfirmReset(db *sqlx.DB, selector string, token string) (int64, error) {
-	if err := checkDatabase(db); err != nil {
-		return -999, err
-	}
-
-	reset, err := dbGetUserResetBySelector(db, selector)
-	if err != nil {
-		return -999, err
-	}
 
-	if !verifyHash(reset.Token.String, token) {
-		return -999, errors.New(ERROR_INVALIDTOKEN)
+// getConfirmableUserByEmail also finds accounts pending review, which
+// confirm their address while they wait.
+func getConfirmableUserByEmail(db *sqlx.DB, email string) (*User, error) {
+	user, err := dbGetUserByEmail(db, email)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return dbGetUserByEmailAndStatus(db, email, STATUS_PENDING_REVIEW)
 	}
-
-	if reset.HasExpired() {
-		return -999, errors.New(ERROR_TOKENEXPIRED)
+	return user, err
+}
+func getConfirmableUserByID(db *sqlx.DB, userID int64) (*User, error) {
+	user, err := dbGetUserByID(db, userID)
+	if err != nil && err.Error() == "sql: no rows in result set" {
+		return dbGetUserByIDAndStatus(db, userID, STATUS_PENDING_REVIEW)
 	}
-
-	return reset.UserID.Int64, nil
+	return user, err
 }
-func DeleteReset(db *sqlx.DB, selector string) error {
+func reviewUser(db *sqlx.DB, userID int64, reviewerID int64, decision string, reason string) error {
 	if err := checkDatabase(db); err != nil {
 		return err
 	}
 
-	err := dbDeleteUserReset(db, selector)
+	user, err := dbGetUserByIDAndStatus(db, userID, STATUS_PENDING_REVIEW)
 	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return errors.New(ERROR_NOTPENDING)
+		}
 		return err
 	}
-	return nil
-}
-func ResetPassword(db *sqlx.DB, email string, password string) error {
-	if err := checkDatabase(db); err != nil {
+
+	status, event := STATUS_NORMAL, AUDIT_ACCOUNT_APPROVED
+	if decision == REVIEW_REJECTED {
+		status, event = STATUS_ARCHIVED, AUDIT_ACCOUNT_REJECTED
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
 		return err
 	}
 
-	user, err := dbGetUserByEmail(db, email)
+	err = dbTxUpdateUserStatus(tx, user.GetID(), status)
 	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
 
-	if !user.IsVerified() {
-		return errors.New(ERROR_EMAILNOTVERIFIED)
+	// the archived account keeps its review but not its address
+	if decision == REVIEW_REJECTED {
+		err = dbTxReleaseUserEmail(tx, user.GetID())
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
 	}
 
-	if !user.IsResettable() {
-		return errors.New(ERROR_RESETDISABLED)
+	_, err = dbTxCreateUserReview(tx, NewUserReview(user.GetID(), reviewerID, decision, reason))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
 	}
 
-	if !user.Status.Valid && user.Status.Int64 != STATUS_NORMAL {
-		return errors.New(ERROR_USERBLOCKED)
+	err = txEmitAuditEvent(tx, user.GetID(), event)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
 	}
 
-	err = dbUpdateUser(
-		db,
-		user.GetID(),
-		database.NewFieldValuePairCollection(
-			database.NewFieldValuePair("password", hashPassword(password)),
-		),
-	)
+	err = tx.Commit()
 	if err != nil {
 		return err
 	}
 
+	notifyAuditEvent(user.GetID(), event)
+
+	// the decision stands even if the user could not be told about it
+	if cb := getReviewCallBack(); cb != nil {
+		err = cb(user.Email.String, decision, reason)
+		if err != nil {
+			return &ReviewNotSentError{Err: err}
+		}
+	}
+
 	return nil
 }
-func ResetPasswordWithID(db *sqlx.DB, userID int64, password string) error {
-	if err := checkDatabase(db); err != nil {
+
+// setUserPassword checks password against the policy and the user's history,
+// stores its hash and remembers the replaced one.
+func setUserPassword(db *sqlx.DB, user *User, password string) error {
+	if err := checkNewPassword(db, user, password); err != nil {
 		return err
 	}
 
-	user, err := dbGetUserByID(db, userID)
+	tx, err := db.Beginx()
 	if err != nil {
-		if err.Error() == "sql: no rows in result set" {
-			return errors.New(ERROR_INVALIDUSERID)
-		}
 		return err
 	}
 
-	if !user.IsVerified() {
-		return errors.New(ERROR_EMAILNOTVERIFIED)
+	err = txSetUserPassword(tx, user, password, false)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
 	}
 
-	if !user.IsResettable() {
-		return errors.New(ERROR_RESETDISABLED)
+	err = tx.Commit()
+	if err != nil {
+		return err
 	}
 
-	if !user.Status.Valid && user.Status.Int64 != STATUS_NORMAL {
-		return errors.New(ERROR_USERBLOCKED)
+	return nil
+}
+func checkNewPassword(db *sqlx.DB, user *User, password string) error {
+	if err := checkPassword(password, user.Email.String); err != nil {
+		return err
 	}
 
-	err = dbUpdateUser(
-		db,
-		user.GetID(),
-		database.NewFieldValuePairCollection(
-			database.NewFieldValuePair("password", hashPassword(password)),
-		),
-	)
-	if err != nil {
+	if err := checkPasswordHistory(db, user, password); err != nil {
 		return err
 	}
 
 	return nil
 }
-func ReconfirmPassword(db *sqlx.DB, email string, password string) error {
-	if err := checkDatabase(db); err != nil {
+func txSetUserPassword(tx *sqlx.Tx, user *User, password string, mustChange bool) error {
+	hash, err := hashPassword(password)
+	if err != nil {
 		return err
 	}
 
-	user, err := dbGetUserByEmail(db, email)
+	err = dbTxUpdateUserPassword(tx, user.GetID(), hash, mustChange)
 	if err != nil {
 		return err
 	}
 
-	if !verifyHash(user.Password.String, password) {
-		return errors.New(ERROR_INVALIDPASSWORD)
+	err = txRecordPasswordHistory(tx, user.GetID(), user.Password.String)
+	if err != nil {
+		return err
 	}
 
 	return nil
@@ -1,9 +1,28 @@
 package auth
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 var db *sqlx.DB
@@ -25,7 +44,7 @@ func TestRegister(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = Register(db, "j.doe@hotmail.com", "password123")
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
 	if err != nil {
 		t.Error(err)
 	}
@@ -35,7 +54,7 @@ func TestRegister(t *testing.T) {
 		t.Error(err)
 	}
 
-	if !verifyHash(user.Password.String, "password123") {
+	if !verifyHash(user.Password.String, "correct-horse-42") {
 		t.FailNow()
 	}
 
@@ -47,7 +66,7 @@ func TestRegisterInvalidEmail(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = Register(db, "j.doehotmail.com", "password123")
+	err = Register(db, "j.doehotmail.com", "correct-horse-42")
 	if err != nil {
 		if err.Error() != ERROR_INVALIDEMAIL {
 			t.Error(err)
@@ -62,12 +81,12 @@ func TestRegisterDuplicateEmail(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = Register(db, "j.doe@hotmail.com", "password123")
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = Register(db, "j.doe@hotmail.com", "password123")
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
 	if err == nil {
 		t.FailNow()
 	}
@@ -83,7 +102,7 @@ func TestRegisterWithConfirmation(t *testing.T) {
 	err = RegisterWithConfirmation(
 		db,
 		"j.doe@hotmail.com",
-		"password123",
+		"correct-horse-42",
 		func(selector string, token string) error {
 			err := ConfirmEmail(db, selector, token)
 			return err
@@ -119,7 +138,7 @@ func TestLogin(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = Register(db, "j.doe@hotmail.com", "password123")
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
 	if err != nil {
 		t.Error(err)
 	}
@@ -131,7 +150,7 @@ func TestLogin(t *testing.T) {
 
 	_ = user
 
-	_, err = Login(db, "j.doe@hotmail.com", "password123")
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
 	if err != nil {
 		t.Error(err)
 	}
@@ -153,7 +172,7 @@ func TestFailedLogin(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = Register(db, "j.doe@hotmail.com", "password123")
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
 	if err != nil {
 		t.Error(err)
 	}
@@ -171,7 +190,7 @@ func TestGetUserByEmail(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = Register(db, "j.doe@hotmail.com", "password123")
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
 	if err != nil {
 		t.Error(err)
 	}
@@ -209,7 +228,7 @@ func TestForgotPassword(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = Register(db, "j.doe@hotmail.com", "password123")
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
 	if err != nil {
 		t.Error(err)
 	}
@@ -230,7 +249,7 @@ func TestResetPassword(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = Register(db, "j.doe@hotmail.com", "password123")
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
 	if err != nil {
 		t.Error(err)
 	}
@@ -253,15 +272,3115 @@ func TestReconfirmPassword(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = Register(db, "j.doe@hotmail.com", "password123")
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ReconfirmPassword(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestRequestEmailChange(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	user, err := dbGetUserByEmail(db, "j.doe@hotmail.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RequestEmailChange(
+		db,
+		user.GetID(),
+		"john.doe@gmail.com",
+		"correct-horse-42",
+		func(selector string, token string) error {
+			return ConfirmEmail(db, selector, token)
+		},
+		func(selector string, token string) error {
+			return nil
+		},
+	)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = dbGetUserByEmail(db, "john.doe@gmail.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestRequestEmailChangeTaken(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "john.doe@gmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	user, err := dbGetUserByEmail(db, "j.doe@hotmail.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RequestEmailChange(
+		db,
+		user.GetID(),
+		"john.doe@gmail.com",
+		"correct-horse-42",
+		func(selector string, token string) error {
+			return nil
+		},
+		func(selector string, token string) error {
+			return nil
+		},
+	)
+	if err == nil || err.Error() != ERROR_EMAILTAKEN {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestRevertEmailChange(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	user, err := dbGetUserByEmail(db, "j.doe@hotmail.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var revertSelector, revertToken string
+	err = RequestEmailChange(
+		db,
+		user.GetID(),
+		"john.doe@gmail.com",
+		"correct-horse-42",
+		func(selector string, token string) error {
+			return ConfirmEmail(db, selector, token)
+		},
+		func(selector string, token string) error {
+			revertSelector, revertToken = selector, token
+			return nil
+		},
+	)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RevertEmailChange(db, revertSelector, revertToken)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = dbGetUserByEmail(db, "j.doe@hotmail.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestResendConfirmation(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	var firstSelector, firstToken string
+	err = RegisterWithConfirmation(
+		db,
+		"j.doe@hotmail.com",
+		"correct-horse-42",
+		func(selector string, token string) error {
+			firstSelector, firstToken = selector, token
+			return nil
+		},
+	)
+	if err != nil {
+		t.Error(err)
+	}
+
+	send := func(selector string, token string) error {
+		return nil
+	}
+
+	err = ResendConfirmation(db, "j.doe@hotmail.com", send)
+	if err == nil || err.Error() != ERROR_RESENDCOOLDOWN {
+		t.FailNow()
+	}
+
+	_, err = db.Exec("UPDATE users SET confirmation_sent=confirmation_sent-300")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var selector, token string
+	err = ResendConfirmation(
+		db,
+		"j.doe@hotmail.com",
+		func(s string, tk string) error {
+			selector, token = s, tk
+			return nil
+		},
+	)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ConfirmEmail(db, firstSelector, firstToken)
+	if err == nil {
+		t.FailNow()
+	}
+
+	err = ConfirmEmail(db, selector, token)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestResendConfirmationLimit(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	send := func(selector string, token string) error {
+		return nil
+	}
+
+	err = RegisterWithConfirmation(db, "j.doe@hotmail.com", "correct-horse-42", send)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := int64(0); i < getMaxConfirmationResends(); i++ {
+		_, err = db.Exec("UPDATE users SET confirmation_sent=confirmation_sent-300")
+		if err != nil {
+			t.Error(err)
+		}
+
+		err = ResendConfirmation(db, "j.doe@hotmail.com", send)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	_, err = db.Exec("UPDATE users SET confirmation_sent=confirmation_sent-300")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ResendConfirmation(db, "j.doe@hotmail.com", send)
+	if err == nil || err.Error() != ERROR_TOOMANYREQUESTS {
+		t.FailNow()
+	}
+
+	// purging the expired links does not lift the limit
+	_, err = db.Exec("DELETE FROM users_confirmations")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ResendConfirmation(db, "j.doe@hotmail.com", send)
+	if err == nil || err.Error() != ERROR_TOOMANYREQUESTS {
+		t.FailNow()
+	}
+
+	// but a quiet day does
+	_, err = db.Exec("UPDATE users SET confirmation_sent=confirmation_sent-86400")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ResendConfirmation(db, "j.doe@hotmail.com", send)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestResendConfirmationEnumerationSafe(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	SetEnumerationSafe(true, nil)
+	defer SetEnumerationSafe(false, nil)
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	sent := 0
+	send := func(selector string, token string) error {
+		sent++
+		return nil
+	}
+
+	err = ResendConfirmation(db, "j.doe@hotmail.com", send)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ResendConfirmation(db, "jane.doe@hotmail.com", send)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if sent != 0 {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestRegisterWeakPassword(t *testing.T) {
+	err := setup()
 	if err != nil {
 		t.Error(err)
 	}
 
-	err = ReconfirmPassword(db, "j.doe@hotmail.com", "password123")
+	err = Register(db, "j.doe@hotmail.com", "password123")
+	if err == nil || err.Error() != ERROR_PASSWORDPOLICY {
+		t.FailNow()
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "")
+	if err == nil || err.Error() != ERROR_PASSWORDPOLICY {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestRegisterPasswordOverBcryptLimit(t *testing.T) {
+	err := setup()
 	if err != nil {
 		t.Error(err)
 	}
 
+	// 41 characters but 81 bytes
+	password := strings.Repeat("å", 40) + "x"
+
+	err = Register(db, "j.doe@hotmail.com", password)
+	if err == nil || err.Error() != ERROR_PASSWORDPOLICY {
+		t.FailNow()
+	}
+
+	SetPasswordPolicy(nil)
+	defer SetPasswordPolicy(NewPasswordPolicy())
+
+	err = Register(db, "j.doe@hotmail.com", password)
+	if err == nil {
+		t.FailNow()
+	}
+
+	count, err := dbGetUserCountByEmail(db, "j.doe@hotmail.com")
+	if err != nil || count != 0 {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestPasswordPolicy(t *testing.T) {
+	policy := NewPasswordPolicy()
+	policy.AddRule("no_spaces", func(password string, email string) bool {
+		return !strings.Contains(password, " ")
+	})
+
+	err := policy.Check("johnny2023 x", "johnny@hotmail.com")
+	perr, ok := err.(*PasswordPolicyError)
+	if !ok {
+		t.FailNow()
+	}
+
+	if !perr.Has(PASSWORD_RULE_EMAIL) || !perr.Has("no_spaces") || perr.Has(PASSWORD_RULE_MINLENGTH) {
+		t.FailNow()
+	}
+
+	// seven characters, nine bytes
+	err = policy.Check("ååå1234", "")
+	perr, ok = err.(*PasswordPolicyError)
+	if !ok || !perr.Has(PASSWORD_RULE_MINLENGTH) {
+		t.FailNow()
+	}
+
+	// the fullwidth form normalizes to a blocklisted password
+	err = policy.Check("ｐａｓｓｗｏｒｄ１２３", "")
+	perr, ok = err.(*PasswordPolicyError)
+	if !ok || !perr.Has(PASSWORD_RULE_BLOCKLIST) {
+		t.FailNow()
+	}
+
+	err = policy.Check("correct-horse-42", "j.doe@hotmail.com")
+	if err != nil {
+		t.Error(err)
+	}
+}
+func TestHIBPIndex(t *testing.T) {
+	counts := map[string]int64{
+		"correct-horse-42": 3,
+		"tr0ub4dor&3":      120,
+		"letmein2023":      5000,
+	}
+
+	hashes := make([]string, 0)
+	lines := make(map[string]string)
+	for pw, count := range counts {
+		hash := strings.ToUpper(hex.EncodeToString(sha1Sum(pw)))
+		hashes = append(hashes, hash)
+		lines[hash] = fmt.Sprintf("%s:%d", hash, count)
+	}
+	sort.Strings(hashes)
+
+	dump := new(bytes.Buffer)
+	for _, hash := range hashes {
+		dump.WriteString(lines[hash] + "\r\n")
+	}
+
+	buf := new(bytes.Buffer)
+	written, err := BuildHIBPIndex(dump, buf, 1)
+	if err != nil {
+		t.Error(err)
+	}
+	if written != 3 {
+		t.FailNow()
+	}
+
+	index, err := NewHIBPIndex(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Error(err)
+	}
+
+	for pw, count := range counts {
+		n, err := index.BreachCount(pw)
+		if err != nil {
+			t.Error(err)
+		}
+		if n != count {
+			t.FailNow()
+		}
+	}
+
+	n, err := index.BreachCount("not-in-the-dump")
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 0 {
+		t.FailNow()
+	}
+
+	policy := NewPasswordPolicy()
+	policy.Breaches = index
+	policy.BreachThreshold = 100
+
+	if policy.Check("correct-horse-42", "") != nil {
+		t.FailNow()
+	}
+
+	err = policy.Check("tr0ub4dor&3", "")
+	perr, ok := err.(*PasswordPolicyError)
+	if !ok || !perr.Has(PASSWORD_RULE_BREACHED) {
+		t.FailNow()
+	}
+}
+func TestBuildHIBPIndexUnsorted(t *testing.T) {
+	dump := strings.NewReader(
+		"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:1\n" +
+			"0000000000000000000000000000000000000000:1\n",
+	)
+
+	_, err := BuildHIBPIndex(dump, new(bytes.Buffer), 1)
+	if err == nil {
+		t.FailNow()
+	}
+}
+func sha1Sum(s string) []byte {
+	sum := sha1.Sum([]byte(s))
+	return sum[:]
+}
+func TestResetPasswordReuse(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ResetPassword(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err == nil || err.Error() != ERROR_PASSWORDREUSED {
+		t.FailNow()
+	}
+
+	err = ResetPassword(db, "j.doe@hotmail.com", "battery-staple-17")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ResetPassword(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err == nil || err.Error() != ERROR_PASSWORDREUSED {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestPasswordHistoryLength(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	SetPasswordHistory(2, 0)
+	defer SetPasswordHistory(5, 0)
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, pw := range []string{"battery-staple-17", "purple-monkey-dish", "quiet-river-stone"} {
+		err = ResetPassword(db, "j.doe@hotmail.com", pw)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	user, err := dbGetUserByEmail(db, "j.doe@hotmail.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	history, err := dbGetUserPasswordHistoryByUserID(db, user.GetID())
+	if err != nil {
+		t.Error(err)
+	}
+	if len(history) != 2 {
+		t.FailNow()
+	}
+
+	// dropped from the history, so it may be used again
+	err = ResetPassword(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestMinPasswordAge(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	SetPasswordHistory(5, time.Hour)
+	defer SetPasswordHistory(5, 0)
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// counted from registration, with no history yet
+	err = ChangePassword(db, 1, "correct-horse-42", "battery-staple-17")
+	if err == nil || err.Error() != ERROR_PASSWORDTOOYOUNG {
+		t.FailNow()
+	}
+
+	// a forgotten password can always be reset
+	err = ResetPassword(db, "j.doe@hotmail.com", "battery-staple-17")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ResetPassword(db, "j.doe@hotmail.com", "purple-monkey-dish")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("UPDATE users SET password_changed_at=0")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ChangePassword(db, 1, "purple-monkey-dish", "quiet-river-stone")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestSetTemporaryPassword(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	SetPasswordHistory(5, time.Hour)
+	defer SetPasswordHistory(5, 0)
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	user, err := dbGetUserByEmail(db, "j.doe@hotmail.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = dbCreateUserRemember(db, NewUserRemember(user.GetID(), getUserRememberedExpiry()))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = SetTemporaryPassword(db, user.GetID(), "temporary-pass-9")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var count int64
+	err = db.Get(&count, "SELECT COUNT(*) FROM users_remembered")
+	if err != nil || count != 0 {
+		t.FailNow()
+	}
+
+	updated, err := dbGetUserByID(db, user.GetID())
+	if err != nil || updated.ForceLogout.Int64 != user.ForceLogout.Int64+1 {
+		t.FailNow()
+	}
+
+	id, err := Login(db, "j.doe@hotmail.com", "temporary-pass-9")
+	if err == nil || err.Error() != ERROR_PASSWORDCHANGE || id != user.GetID() {
+		t.FailNow()
+	}
+
+	err = ResetPasswordWithID(db, id, "battery-staple-17")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "battery-staple-17")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestPasswordExpiry(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	SetPasswordExpiry(time.Hour)
+	defer SetPasswordExpiry(0)
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("UPDATE users SET password_changed_at=0")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err == nil || err.Error() != ERROR_PASSWORDCHANGE {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestChangePassword(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	id, err := Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Remember(db, id, getUserRememberedExpiry(), func(selector string, token string) error {
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	var events []string
+	SetAuditCallBack(func(userID int64, event string) {
+		events = append(events, event)
+	})
+	defer SetAuditCallBack(nil)
+
+	err = ChangePassword(db, id, "wrong-password-1", "battery-staple-17")
+	if err == nil || err.Error() != ERROR_INVALIDPASSWORD {
+		t.FailNow()
+	}
+
+	err = ChangePassword(db, id, "correct-horse-42", "battery-staple-17")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "battery-staple-17")
+	if err != nil {
+		t.Error(err)
+	}
+
+	remembered, err := dbGetUserRememberByUserID(db, id)
+	if err != nil {
+		t.Error(err)
+	}
+
+	user, err := dbGetUserByID(db, id)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(remembered) != 0 || user.ForceLogout.Int64 != 1 {
+		t.FailNow()
+	}
+
+	if len(events) != 1 || events[0] != AUDIT_PASSWORD_CHANGED {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestCompleteReset(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	user, err := dbGetUserByEmail(db, "j.doe@hotmail.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Remember(db, user.GetID(), getUserRememberedExpiry(), func(selector string, token string) error {
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	var selector, token string
+	err = ResetPasswordWithConfirmation(
+		db,
+		"j.doe@hotmail.com",
+		func(s string, tk string) error {
+			selector, token = s, tk
+			return nil
+		},
+	)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = CompleteReset(db, selector, token, "password123")
+	if err == nil || err.Error() != ERROR_PASSWORDPOLICY {
+		t.FailNow()
+	}
+
+	err = CompleteReset(db, selector, token, "battery-staple-17")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "battery-staple-17")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = CompleteReset(db, selector, token, "purple-monkey-dish")
+	if err == nil || err.Error() != ERROR_INVALIDSELECTOR {
+		t.FailNow()
+	}
+
+	remembered, err := dbGetUserRememberByUserID(db, user.GetID())
+	if err != nil {
+		t.Error(err)
+	}
+	if len(remembered) != 0 {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestCompleteResetBlockedUser(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var selector, token string
+	err = ResetPasswordWithConfirmation(
+		db,
+		"j.doe@hotmail.com",
+		func(s string, tk string) error {
+			selector, token = s, tk
+			return nil
+		},
+	)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Ban(db, 1, "fraud", 99)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = CompleteReset(db, selector, token, "battery-staple-17")
+	if err == nil || err.Error() != ERROR_USERBLOCKED {
+		t.FailNow()
+	}
+
+	err = Reinstate(db, 1, "appeal", 99)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestRegisterWithConfirmationRollback(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RegisterWithConfirmation(
+		db,
+		"j.doe@hotmail.com",
+		"correct-horse-42",
+		func(selector string, token string) error {
+			return errors.New(ERROR_SENDCONFIRM)
+		},
+	)
+	if err == nil || err.Error() != ERROR_SENDCONFIRM {
+		t.FailNow()
+	}
+
+	count, err := dbGetUserCountByEmail(db, "j.doe@hotmail.com")
+	if err != nil {
+		t.Error(err)
+	}
+	if count != 0 {
+		t.FailNow()
+	}
+
+	err = RegisterWithConfirmation(
+		db,
+		"j.doe@hotmail.com",
+		"correct-horse-42",
+		func(selector string, token string) error {
+			return nil
+		},
+	)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestEnumerationSafeLogin(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	SetEnumerationSafe(true, nil)
+	defer SetEnumerationSafe(false, nil)
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "john.doe@gmail.com", "correct-horse-42")
+	if err == nil || err.Error() != ERROR_INVALIDLOGIN {
+		t.FailNow()
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "wrong-password-1")
+	if err == nil || err.Error() != ERROR_INVALIDLOGIN {
+		t.FailNow()
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestEnumerationSafeRegisterAndReset(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	notices := make(chan string, 1)
+	SetEnumerationSafe(true, func(email string, notice string) error {
+		notices <- email + " " + notice
+		return nil
+	})
+	defer SetEnumerationSafe(false, nil)
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "battery-staple-17")
+	if err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case notice := <-notices:
+		if notice != "j.doe@hotmail.com "+NOTICE_ACCOUNT_EXISTS {
+			t.FailNow()
+		}
+	case <-time.After(time.Second):
+		t.FailNow()
+	}
+
+	called := false
+	err = ResetPasswordWithConfirmation(db, "john.doe@gmail.com", func(selector string, token string) error {
+		called = true
+		return nil
+	})
+	if err != nil || called {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestEmailSender(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	dir := t.TempDir()
+	sender := NewEmailSender(NewFileMailer(dir, "noreply@example.com"), "https://example.com/")
+
+	err = RegisterWithConfirmation(db, "j.doe@hotmail.com", "correct-horse-42", sender.Confirmation("j.doe@hotmail.com"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(files) != 1 {
+		t.FailNow()
+	}
+
+	f, err := os.Open(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Error(err)
+	}
+	defer f.Close()
+
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if msg.Header.Get("To") != "j.doe@hotmail.com" || msg.Header.Get("Subject") != "Confirm your email address" {
+		t.FailNow()
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	part, err := multipart.NewReader(msg.Body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Error(err)
+	}
+
+	text, err := io.ReadAll(part)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !strings.Contains(string(text), "https://example.com/confirm-email?selector=") {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+
+type testMailer struct {
+	sent []string
+	fail bool
+}
+
+func (m *testMailer) Send(to string, subject string, text string, html string) error {
+	if m.fail {
+		return errors.New("connection refused")
+	}
+	m.sent = append(m.sent, to)
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	mailer := new(testMailer)
+	outbox := NewOutbox(db, mailer)
+	sender := NewEmailSender(outbox, "https://example.com")
+
+	err = RegisterWithConfirmation(db, "j.doe@hotmail.com", "correct-horse-42", sender.Confirmation("j.doe@hotmail.com"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(mailer.sent) != 0 {
+		t.FailNow()
+	}
+
+	sent, err := outbox.Dispatch()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if sent != 1 || len(mailer.sent) != 1 || mailer.sent[0] != "j.doe@hotmail.com" {
+		t.FailNow()
+	}
+
+	sentMessages, err := dbGetOutboxMessagesByStatus(db, OUTBOX_SENT)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(sentMessages) != 1 || sentMessages[0].TextBody.String != "" {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestOutboxTransaction(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	mailer := new(testMailer)
+	sender := NewEmailSender(NewOutbox(db, mailer), "https://example.com")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Error(err)
+	}
+
+	queued, err := txQueueCallBack(tx, sender.Confirmation("j.doe@hotmail.com"), "selector", "token")
+	if err != nil || !queued {
+		t.FailNow()
+	}
+
+	// rolled back with the token
+	_ = tx.Rollback()
+
+	var count int64
+	err = db.Get(&count, "SELECT COUNT(*) FROM auth_outbox")
+	if err != nil || count != 0 {
+		t.FailNow()
+	}
+
+	tx, err = db.Beginx()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// other callbacks are left for after the commit
+	called := false
+	queued, err = txQueueCallBack(tx, func(selector string, token string) error {
+		called = true
+		return nil
+	}, "selector", "token")
+	if err != nil || queued || called {
+		t.FailNow()
+	}
+
+	queued, err = txQueueCodeCallBack(tx, sender.Code("j.doe@hotmail.com"), "123456")
+	if err != nil || !queued {
+		t.FailNow()
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = db.Get(&count, "SELECT COUNT(*) FROM auth_outbox")
+	if err != nil || count != 1 || len(mailer.sent) != 0 {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestOutboxDeadLetter(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	mailer := &testMailer{fail: true}
+	outbox := NewOutbox(db, mailer)
+	outbox.MaxAttempts = 2
+	outbox.BaseBackoff = 0
+
+	err = outbox.Send("j.doe@hotmail.com", "Hello", "Hello", "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err = outbox.Dispatch()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	dead, err := outbox.DeadLetters()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(dead) != 1 || dead[0].Attempts.Int64 != 2 || dead[0].LastError.String != "connection refused" {
+		t.FailNow()
+	}
+
+	mailer.fail = false
+	err = outbox.Replay(dead[0].GetID())
+	if err != nil {
+		t.Error(err)
+	}
+
+	sent, err := outbox.Dispatch()
+	if err != nil {
+		t.Error(err)
+	}
+	if sent != 1 {
+		t.FailNow()
+	}
+
+	// sent, so its bodies are gone
+	err = outbox.Replay(dead[0].GetID())
+	if err == nil || err.Error() != ERROR_NOTDEADLETTER {
+		t.FailNow()
+	}
+
+	err = outbox.Replay(99)
+	if err == nil || err.Error() != ERROR_NOTDEADLETTER {
+		t.FailNow()
+	}
+
+	err = outbox.Run(context.Background(), 0)
+	if err == nil || err.Error() != ERROR_INVALIDINTERVAL {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestOutboxClaim(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	mailer := new(testMailer)
+	outbox := NewOutbox(db, mailer)
+
+	err = outbox.Send("j.doe@hotmail.com", "Hello", "Hello", "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// another dispatcher is sending it
+	now := time.Now()
+	claimed, err := dbClaimOutboxMessage(db, 1, now.Unix(), now.Add(time.Minute).Unix())
+	if err != nil || !claimed {
+		t.FailNow()
+	}
+
+	sent, err := outbox.Dispatch()
+	if err != nil {
+		t.Error(err)
+	}
+	if sent != 0 || len(mailer.sent) != 0 {
+		t.FailNow()
+	}
+
+	// and died before its lease ran out
+	_, err = db.Exec("UPDATE auth_outbox SET next_attempt=0")
+	if err != nil {
+		t.Error(err)
+	}
+
+	sent, err = outbox.Dispatch()
+	if err != nil {
+		t.Error(err)
+	}
+	if sent != 1 || len(mailer.sent) != 1 {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestLocalizeError(t *testing.T) {
+	err := errors.New(ERROR_INVALIDPASSWORD)
+
+	if LocalizeError("sv-SE", err) != "Lösenordet är fel." {
+		t.FailNow()
+	}
+
+	if LocalizeError("de", err) != "Das Passwort ist falsch." {
+		t.FailNow()
+	}
+
+	if LocalizeError("en-GB", err) != "The password is incorrect." {
+		t.FailNow()
+	}
+
+	if LocalizeError("fr", err) != "The password is incorrect." {
+		t.FailNow()
+	}
+
+	if LocalizeMessage("sv", "not a message id") != "not a message id" {
+		t.FailNow()
+	}
+}
+func TestLoadTemplatesMissingFile(t *testing.T) {
+	sender := NewEmailSender(new(testMailer), "https://example.com")
+
+	err := sender.LoadTemplates(fstest.MapFS{
+		"en/reset.html": &fstest.MapFile{Data: []byte("<p>{{.Link}}</p>")},
+	})
+	if err == nil {
+		t.FailNow()
+	}
+
+	err = sender.LoadTemplates(fstest.MapFS{
+		"en/reset.txt":  &fstest.MapFile{Data: []byte(`{{define "subject"}}Reset{{end}}{{.Link}}`)},
+		"en/reset.html": &fstest.MapFile{Data: []byte("<p>{{.Link}}</p>")},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+func TestEmailSenderLocale(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	user, err := dbGetUserByEmail(db, "j.doe@hotmail.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = SetUserLocale(db, user.GetID(), "sv_SE")
+	if err != nil {
+		t.Error(err)
+	}
+
+	locale, err := GetUserLocale(db, user.GetID())
+	if err != nil {
+		t.Error(err)
+	}
+	if locale != "sv-se" {
+		t.FailNow()
+	}
+
+	sender := NewEmailSender(new(testMailer), "https://example.com").WithLocale(locale)
+	subject, _, html, err := sender.render(EMAIL_RESET, &emailData{Email: "j.doe@hotmail.com", Link: "https://example.com/reset-password"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if subject != "Återställ ditt lösenord" || !strings.Contains(html, "j.doe@hotmail.com") {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestLoginLink(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RegisterWithConfirmation(db, "j.doe@hotmail.com", "correct-horse-42", func(selector string, token string) error {
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	var selector, token string
+	err = RequestLoginLink(db, "j.doe@hotmail.com", func(s string, tk string) error {
+		selector, token = s, tk
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	id, err := ConsumeLoginLink(db, selector, token)
+	if err != nil {
+		t.Error(err)
+	}
+
+	user, err := dbGetUserByID(db, id)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !user.IsVerified() || !user.LastLogin.Valid {
+		t.FailNow()
+	}
+
+	_, err = ConsumeLoginLink(db, selector, token)
+	if err == nil || err.Error() != ERROR_INVALIDSELECTOR {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestLoginLinkBlocked(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("UPDATE users SET status=?", STATUS_PENDING_REVIEW)
+	if err != nil {
+		t.Error(err)
+	}
+
+	called := false
+	sendLink := func(selector string, token string) error {
+		called = true
+		return nil
+	}
+
+	err = RequestLoginLink(db, "j.doe@hotmail.com", sendLink)
+	if err == nil || err.Error() != ERROR_PENDINGREVIEW {
+		t.FailNow()
+	}
+
+	_, err = db.Exec("UPDATE users SET status=?", STATUS_BANNED)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RequestLoginLink(db, "j.doe@hotmail.com", sendLink)
+	if err == nil || err.Error() != ERROR_USERBLOCKED {
+		t.FailNow()
+	}
+
+	notices := make(chan string, 1)
+	SetEnumerationSafe(true, func(email string, notice string) error {
+		notices <- notice
+		return nil
+	})
+	defer SetEnumerationSafe(false, nil)
+
+	err = RequestLoginLink(db, "j.doe@hotmail.com", sendLink)
+	if err != nil || called {
+		t.FailNow()
+	}
+
+	select {
+	case notice := <-notices:
+		if notice != NOTICE_LOGIN_UNAVAILABLE {
+			t.FailNow()
+		}
+	case <-time.After(time.Second):
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestLoginLinkExpired(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var selector, token string
+	err = RequestLoginLink(db, "j.doe@hotmail.com", func(s string, tk string) error {
+		selector, token = s, tk
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("UPDATE users_login_links SET expires=0")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ConsumeLoginLink(db, selector, token)
+	if err == nil || err.Error() != ERROR_TOKENEXPIRED {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestRegisterWithConfirmationCode(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	SetConfirmationMethod(CONFIRMATION_CODE)
+	defer SetConfirmationMethod(CONFIRMATION_LINK)
+
+	var selector, code string
+	err = RegisterWithConfirmation(db, "j.doe@hotmail.com", "correct-horse-42", func(s string, tk string) error {
+		selector, code = s, tk
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if selector != "" || len(code) != 6 {
+		t.FailNow()
+	}
+
+	err = ConfirmEmailWithCode(db, "j.doe@hotmail.com", code)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestLoginCodeAttempts(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var code string
+	err = RequestLoginCode(db, "j.doe@hotmail.com", func(c string) error {
+		code = c
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+
+	for i := int64(1); i < getMaxCodeAttempts(); i++ {
+		_, err = ConsumeLoginCode(db, "j.doe@hotmail.com", wrong)
+		if err == nil || err.Error() != ERROR_INVALIDCODE {
+			t.FailNow()
+		}
+	}
+
+	_, err = ConsumeLoginCode(db, "j.doe@hotmail.com", wrong)
+	if err == nil || err.Error() != ERROR_TOOMANYREQUESTS {
+		t.FailNow()
+	}
+
+	// the code stops working once the attempts are used up
+	_, err = ConsumeLoginCode(db, "j.doe@hotmail.com", code)
+	if err == nil || err.Error() != ERROR_TOOMANYREQUESTS {
+		t.FailNow()
+	}
+
+	// and a new code does not bring new attempts
+	_, err = db.Exec("UPDATE users_codes SET sent=sent-60")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RequestLoginCode(db, "j.doe@hotmail.com", func(c string) error {
+		code = c
+		return nil
+	})
+	if err == nil || err.Error() != ERROR_TOOMANYREQUESTS {
+		t.FailNow()
+	}
+
+	_, err = db.Exec("UPDATE users_codes SET window_ends=window_ends-3601")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RequestLoginCode(db, "j.doe@hotmail.com", func(c string) error {
+		code = c
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ConsumeLoginCode(db, "j.doe@hotmail.com", code)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestLoginCodeReissue(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var code string
+	sendCode := func(c string) error {
+		code = c
+		return nil
+	}
+
+	err = RequestLoginCode(db, "j.doe@hotmail.com", sendCode)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RequestLoginCode(db, "j.doe@hotmail.com", sendCode)
+	if err == nil || err.Error() != ERROR_TOOMANYREQUESTS {
+		t.FailNow()
+	}
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+
+	for i := int64(1); i < getMaxCodeAttempts(); i++ {
+		_, err = ConsumeLoginCode(db, "j.doe@hotmail.com", wrong)
+		if err == nil || err.Error() != ERROR_INVALIDCODE {
+			t.FailNow()
+		}
+	}
+
+	_, err = db.Exec("UPDATE users_codes SET sent=sent-60")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RequestLoginCode(db, "j.doe@hotmail.com", sendCode)
+	if err != nil {
+		t.Error(err)
+	}
+
+	wrong = "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+
+	// the guesses made against the previous code still count
+	_, err = ConsumeLoginCode(db, "j.doe@hotmail.com", wrong)
+	if err == nil || err.Error() != ERROR_TOOMANYREQUESTS {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestCompleteResetWithCode(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var code string
+	err = RequestResetCode(db, "j.doe@hotmail.com", func(c string) error {
+		code = c
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	var stored string
+	err = db.Get(&stored, "SELECT code FROM users_codes")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if stored == code {
+		t.FailNow()
+	}
+
+	err = CompleteResetWithCode(db, "j.doe@hotmail.com", code, "battery-staple-17")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "battery-staple-17")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = CompleteResetWithCode(db, "j.doe@hotmail.com", code, "purple-monkey-dish")
+	if err == nil || err.Error() != ERROR_INVALIDCODE {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestPhoneTwoFactor(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	id, err := Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	sms := NewFakeSMSSender()
+
+	err = RequestPhoneVerification(db, id, "0701234567", sms)
+	if err == nil || err.Error() != ERROR_INVALIDPHONE {
+		t.FailNow()
+	}
+
+	err = SetPhoneTwoFactor(db, id, true, "")
+	if err == nil || err.Error() != ERROR_PHONENOTVERIFIED {
+		t.FailNow()
+	}
+
+	err = RequestPhoneVerification(db, id, "+46701234567", sms)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ConfirmPhone(db, id, smsCode(sms))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = SetPhoneTwoFactor(db, id, true, "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	loginID, err := Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	var challenge *SecondFactorError
+	if !errors.As(err, &challenge) || err.Error() != ERROR_SECONDFACTOR || loginID != -999 {
+		t.FailNow()
+	}
+
+	// the user ID alone does not start the second step
+	err = RequestSecondFactor(db, challenge.Selector, "wrong-token", sms)
+	if err == nil || err.Error() != ERROR_INVALIDTOKEN {
+		t.FailNow()
+	}
+
+	err = RequestSecondFactor(db, challenge.Selector, challenge.Token, sms)
+	if err != nil {
+		t.Error(err)
+	}
+
+	messages := sms.Messages()
+	if len(messages) != 2 || messages[1].To != "+46701234567" {
+		t.FailNow()
+	}
+
+	loginID, err = VerifySecondFactor(db, challenge.Selector, challenge.Token, smsCode(sms))
+	if err != nil || loginID != id {
+		t.FailNow()
+	}
+
+	// a challenge completes one login only
+	_, err = VerifySecondFactor(db, challenge.Selector, challenge.Token, smsCode(sms))
+	if err == nil || err.Error() != ERROR_INVALIDSELECTOR {
+		t.FailNow()
+	}
+
+	err = SetPhoneTwoFactor(db, id, false, "battery-staple-17")
+	if err == nil || err.Error() != ERROR_INVALIDPASSWORD {
+		t.FailNow()
+	}
+
+	err = SetPhoneTwoFactor(db, id, false, "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestPasswordlessLoginSecondFactor(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	sms := NewFakeSMSSender()
+
+	err = RequestPhoneVerification(db, 1, "+46701234567", sms)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ConfirmPhone(db, 1, smsCode(sms))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = SetPhoneTwoFactor(db, 1, true, "")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var selector, token string
+	err = RequestLoginLink(db, "j.doe@hotmail.com", func(s string, tk string) error {
+		selector, token = s, tk
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ConsumeLoginLink(db, selector, token)
+	if err == nil || err.Error() != ERROR_SECONDFACTOR {
+		t.FailNow()
+	}
+
+	// not logged in until the second factor is verified
+	var count int64
+	err = db.Get(&count, "SELECT COUNT(*) FROM users WHERE last_login>0")
+	if err != nil || count != 0 {
+		t.FailNow()
+	}
+
+	var code string
+	err = RequestLoginCode(db, "j.doe@hotmail.com", func(c string) error {
+		code = c
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ConsumeLoginCode(db, "j.doe@hotmail.com", code)
+	if err == nil || err.Error() != ERROR_SECONDFACTOR {
+		t.FailNow()
+	}
+
+	err = db.Get(&count, "SELECT COUNT(*) FROM users WHERE last_login>0")
+	if err != nil || count != 0 {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestLoginCodeBlocked(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var code string
+	err = RequestLoginCode(db, "j.doe@hotmail.com", func(c string) error {
+		code = c
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("UPDATE users SET status=?", STATUS_BANNED)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the status is only shown to whoever holds the code
+	_, err = ConsumeLoginCode(db, "j.doe@hotmail.com", "wrong")
+	if err == nil || err.Error() != ERROR_INVALIDCODE {
+		t.FailNow()
+	}
+
+	_, err = ConsumeLoginCode(db, "j.doe@hotmail.com", code)
+	if err == nil || err.Error() != ERROR_USERBLOCKED {
+		t.FailNow()
+	}
+
+	SetEnumerationSafe(true, nil)
+	defer SetEnumerationSafe(false, nil)
+
+	_, err = ConsumeLoginCode(db, "j.doe@hotmail.com", code)
+	if err == nil || err.Error() != ERROR_INVALIDCODE {
+		t.FailNow()
+	}
+
+	called := false
+	err = RequestLoginCode(db, "j.doe@hotmail.com", func(c string) error {
+		called = true
+		return nil
+	})
+	if err != nil || called {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestPhoneRecovery(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "jane.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	sms := NewFakeSMSSender()
+
+	err = RequestPhoneVerification(db, 1, "+46701234567", sms)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ConfirmPhone(db, 1, smsCode(sms))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RequestPhoneVerification(db, 2, "+46701234567", sms)
+	if err == nil || err.Error() != ERROR_PHONETAKEN {
+		t.FailNow()
+	}
+
+	err = RequestPhoneRecovery(db, "+46701234567", sms)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = CompletePhoneRecovery(db, "+46701234567", smsCode(sms), "battery-staple-17")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "battery-staple-17")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("UPDATE users SET resettable=0")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RequestPhoneRecovery(db, "+46701234567", sms)
+	if err == nil || err.Error() != ERROR_RESETDISABLED {
+		t.FailNow()
+	}
+
+	SetEnumerationSafe(true, nil)
+	defer SetEnumerationSafe(false, nil)
+
+	sent := len(sms.Messages())
+	err = RequestPhoneRecovery(db, "+46701234567", sms)
+	if err != nil || len(sms.Messages()) != sent {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+
+// smsCode returns the code in the last message sent by sms.
+func smsCode(sms *FakeSMSSender) string {
+	messages := sms.Messages()
+	if len(messages) == 0 {
+		return ""
+	}
+	return regexp.MustCompile("[0-9]{6,8}").FindString(messages[len(messages)-1].Message)
+}
+func TestMigrateEmailKeys(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "J.Doe@Hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// a users table from before email keys
+	columns := make([]string, 0)
+	err = db.Select(&columns, "SELECT name FROM pragma_table_info('users') WHERE name<>'email_key'")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec(fmt.Sprintf(
+		"ALTER TABLE users RENAME TO users_new; CREATE TABLE users AS SELECT %s FROM users_new; DROP TABLE users_new;",
+		strings.Join(columns, ", "),
+	))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = MigrateEmailKeys(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// and again on a table that is up to date
+	err = MigrateEmailKeys(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestLoginWithUsername(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ChangeUsername(db, 1, "JDoe")
+	if err != nil {
+		t.Error(err)
+	}
+
+	id, err := LoginWithIdentifier(db, "jdoe", "correct-horse-42")
+	if err != nil || id != 1 {
+		t.FailNow()
+	}
+
+	id, err = LoginWithIdentifier(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil || id != 1 {
+		t.FailNow()
+	}
+
+	_, err = LoginWithIdentifier(db, "janedoe", "correct-horse-42")
+	if err == nil || err.Error() != ERROR_INVALIDUSERNAME {
+		t.FailNow()
+	}
+
+	err = ChangeUsername(db, 1, "j doe")
+	if err == nil || err.Error() != ERROR_INVALIDUSERNAME {
+		t.FailNow()
+	}
+
+	err = ChangeUsername(db, 1, "Admin")
+	if err == nil || err.Error() != ERROR_INVALIDUSERNAME {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestUsernameWithAt(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// whatever the policy allows, it could never be used to log in
+	SetUsernamePolicy(nil)
+	defer SetUsernamePolicy(NewUsernamePolicy())
+
+	err = ChangeUsername(db, 1, "j@doe")
+	if err == nil || err.Error() != ERROR_INVALIDUSERNAME {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestChangeUsernameReservation(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "jane.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ChangeUsername(db, 1, "jdoe")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ChangeUsername(db, 2, "JDOE")
+	if err == nil || err.Error() != ERROR_USERNAMETAKEN {
+		t.FailNow()
+	}
+
+	err = ChangeUsername(db, 1, "johndoe")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the old name stays reserved for its previous owner
+	err = ChangeUsername(db, 2, "jdoe")
+	if err == nil || err.Error() != ERROR_USERNAMETAKEN {
+		t.FailNow()
+	}
+
+	err = ChangeUsername(db, 1, "jdoe")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("UPDATE users_username_reservations SET expires=1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ChangeUsername(db, 2, "johndoe")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestNormalizeEmail(t *testing.T) {
+	n := NewEmailNormalizer()
+	n.AddGmailRules()
+
+	tests := map[string]string{
+		" J.Doe@Hotmail.COM ":        "j.doe@hotmail.com",
+		"J.Doe+news@googlemail.com":  "jdoe@gmail.com",
+		"jane@Bücher.example":        "jane@xn--bcher-kva.example",
+		"j.doe@hotmail.com.":         "j.doe@hotmail.com",
+		"Jane.Doe+Work@Hotmail.Com":  "jane.doe+work@hotmail.com",
+		"first.last@sub.example.org": "first.last@sub.example.org",
+	}
+
+	for email, want := range tests {
+		got, err := n.Normalize(email)
+		if err != nil || got != want {
+			t.Error(email, got, err)
+		}
+	}
+
+	_, err := n.Normalize("j.doe@")
+	if err == nil {
+		t.FailNow()
+	}
+}
+func TestEmailCaseInsensitive(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "J.Doe@Hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err == nil {
+		t.FailNow()
+	}
+
+	_, err = Login(db, "j.doe@HOTMAIL.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	user, err := dbGetUserByID(db, 1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the address is shown the way it was entered
+	if user.Email.String != "J.Doe@Hotmail.com" {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestRegistrationPolicy(t *testing.T) {
+	p := NewRegistrationPolicy()
+	p.Allow = []string{"example.com", "*.example.com"}
+	p.Deny = []string{"contractors.example.com"}
+
+	tests := map[string]string{
+		"j.doe@example.com":             "",
+		"j.doe@EU.Example.com":          "",
+		"j.doe@contractors.example.com": ERROR_DOMAINNOTALLOWED,
+		"j.doe@hotmail.com":             ERROR_DOMAINNOTALLOWED,
+		"j.doe@notexample.com":          ERROR_DOMAINNOTALLOWED,
+	}
+
+	for email, want := range tests {
+		err := p.Check(email)
+		if (want == "" && err != nil) || (want != "" && (err == nil || err.Error() != want)) {
+			t.Error(email, err)
+		}
+	}
+
+	p = NewRegistrationPolicy()
+	p.AddDisposableDomains("throwaway.test")
+
+	for _, email := range []string{"j.doe@mailinator.com", "j.doe@eu.mailinator.com", "j.doe@throwaway.test"} {
+		err := p.Check(email)
+		if err == nil || err.Error() != ERROR_DISPOSABLEEMAIL {
+			t.Error(email, err)
+		}
+	}
+}
+func TestRegisterDisallowedDomain(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	p := NewRegistrationPolicy()
+	p.Allow = []string{"hotmail.com"}
+	SetRegistrationPolicy(p)
+	defer SetRegistrationPolicy(nil)
+
+	err = Register(db, "j.doe@yopmail.com", "correct-horse-42")
+	if err == nil || err.Error() != ERROR_DOMAINNOTALLOWED {
+		t.FailNow()
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = RequestEmailChange(db, 1, "j.doe@mailinator.com", "correct-horse-42", func(selector string, token string) error {
+		return nil
+	}, func(selector string, token string) error {
+		return nil
+	})
+	if err == nil || err.Error() != ERROR_DOMAINNOTALLOWED {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestRegisterWithInvitation(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	SetInvitationOnly(true)
+	defer SetInvitationOnly(false)
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err == nil || err.Error() != ERROR_INVITATIONONLY {
+		t.FailNow()
+	}
+
+	var selector, token string
+	err = Invite(db, 1, "j.doe@hotmail.com", ROLE_ADMIN, func(s string, tk string) error {
+		selector, token = s, tk
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	id, err := RegisterWithInvitation(db, selector, token, "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	user, err := dbGetUserByID(db, id)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !user.IsVerified() || user.Roles.Int64 != ROLE_ADMIN {
+		t.FailNow()
+	}
+
+	_, err = RegisterWithInvitation(db, selector, token, "correct-horse-42")
+	if err == nil || err.Error() != ERROR_INVALIDSELECTOR {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestRevokeInvitation(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	var selector, token string
+	for _, email := range []string{"j.doe@hotmail.com", "jane.doe@hotmail.com"} {
+		err = Invite(db, 1, email, ROLE_USER, func(s string, tk string) error {
+			selector, token = s, tk
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	pending, err := GetPendingInvitations(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(pending) != 2 || pending[1].Email.String != "jane.doe@hotmail.com" {
+		t.FailNow()
+	}
+
+	err = RevokeInvitation(db, pending[1].GetID())
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = RegisterWithInvitation(db, selector, token, "correct-horse-42")
+	if err == nil || err.Error() != ERROR_INVALIDSELECTOR {
+		t.FailNow()
+	}
+
+	pending, err = GetPendingInvitations(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(pending) != 1 {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestReject(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	SetModeration(true, func(email string, decision string, reason string) error {
+		return errors.New("connection refused")
+	})
+	defer SetModeration(false, nil)
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var notSent *ReviewNotSentError
+	err = Reject(db, 1, 99, "spam")
+	if !errors.As(err, &notSent) || notSent.Err.Error() != "connection refused" {
+		t.FailNow()
+	}
+
+	// the address is free again
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestInviteSameAddress(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, email := range []string{"J.Doe@Hotmail.com", "j.doe@hotmail.com"} {
+		err = Invite(db, 1, email, ROLE_USER, func(s string, tk string) error {
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the second invitation replaces the first
+	pending, err := GetPendingInvitations(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(pending) != 1 {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestModeration(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	decisions := make([]string, 0)
+	SetModeration(true, func(email string, decision string, reason string) error {
+		decisions = append(decisions, email+" "+decision+" "+reason)
+		return nil
+	})
+	defer SetModeration(false, nil)
+
+	var selector, token string
+	err = RegisterWithConfirmation(db, "j.doe@hotmail.com", "correct-horse-42", func(s string, tk string) error {
+		selector, token = s, tk
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// pending accounts still confirm their address
+	err = ConfirmEmail(db, selector, token)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err == nil || err.Error() != ERROR_PENDINGREVIEW {
+		t.FailNow()
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "battery-staple-17")
+	if err == nil || err.Error() != ERROR_INVALIDPASSWORD {
+		t.FailNow()
+	}
+
+	pending, err := GetPendingReviews(db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(pending) != 1 {
+		t.FailNow()
+	}
+
+	err = Approve(db, pending[0].GetID(), 99, "welcome")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Reject(db, pending[0].GetID(), 99, "")
+	if err == nil || err.Error() != ERROR_NOTPENDING {
+		t.FailNow()
+	}
+
+	if len(decisions) != 1 || decisions[0] != "j.doe@hotmail.com approved welcome" {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestModerationReject(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	SetModeration(true, nil)
+	defer SetModeration(false, nil)
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Reject(db, 1, 99, "spam")
+	if err != nil {
+		t.Error(err)
+	}
+
+	reviews, err := dbGetUserReviewsByUserID(db, 1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(reviews) != 1 || reviews[0].Reason.String != "spam" || reviews[0].ReviewerID.Int64 != 99 {
+		t.FailNow()
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err == nil || err.Error() != ERROR_INVALIDEMAIL {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestSuspend(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Suspend(db, 1, time.Now().Add(-time.Hour), "spam", 99)
+	if err == nil || err.Error() != ERROR_INVALIDUNTIL {
+		t.FailNow()
+	}
+
+	err = Suspend(db, 1, time.Now().Add(time.Hour), "spam", 99)
+	if err != nil {
+		t.Error(err)
+	}
+
+	id, err := Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err == nil || err.Error() != ERROR_USERSUSPENDED || id != -999 {
+		t.FailNow()
+	}
+
+	change, err := GetBlockReason(db, 1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if change.GetReason() != "spam" || change.ActorID.Int64 != 99 || change.GetUntil().IsZero() {
+		t.FailNow()
+	}
+
+	// the suspension is lifted by the next login after it ends
+	_, err = db.Exec("UPDATE users SET status_until=1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	history, err := dbGetUserStatusChangesByUserID(db, 1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(history) != 2 || history[1].Status.Int64 != STATUS_NORMAL {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestBanAndSweeper(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "jane.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Ban(db, 1, "fraud", 99)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Suspend(db, 2, time.Now().Add(time.Hour), "cooling off", 99)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err == nil || err.Error() != ERROR_USERBLOCKED {
+		t.FailNow()
+	}
+
+	_, err = db.Exec("UPDATE users SET status_until=1 WHERE id=2")
+	if err != nil {
+		t.Error(err)
+	}
+
+	lifted, err := LiftExpiredSuspensions(db)
+	if err != nil || lifted != 1 {
+		t.FailNow()
+	}
+
+	user, err := dbGetUserByID(db, 2)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if user.Status.Int64 != STATUS_NORMAL {
+		t.FailNow()
+	}
+
+	err = Reinstate(db, 1, "appeal", 99)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestLiftSuspensionAfterBan(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Suspend(db, 1, time.Now().Add(time.Hour), "cooling off", 99)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("UPDATE users SET status_until=1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// read by a sweeper just before the ban
+	suspended, err := dbGetUserByIDNotArchived(db, 1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Ban(db, 1, "fraud", 99)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = reinstateUser(db, suspended, "suspension ended", 0)
+	if err == nil || err.Error() != ERROR_STATUSCHANGED {
+		t.FailNow()
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err == nil || err.Error() != ERROR_USERBLOCKED {
+		t.FailNow()
+	}
+
+	err = RunSuspensionSweeper(context.Background(), db, 0, nil)
+	if err == nil || err.Error() != ERROR_INVALIDINTERVAL {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestBlockStatus(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// reinstating would skip the review
+	_, err = db.Exec("UPDATE users SET status=?", STATUS_PENDING_REVIEW)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Ban(db, 1, "spam", 99)
+	if err == nil || err.Error() != ERROR_INVALIDSTATUS {
+		t.FailNow()
+	}
+
+	_, err = db.Exec("UPDATE users SET status=?", STATUS_NORMAL)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Ban(db, 1, "fraud", 99)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Suspend(db, 1, time.Now().Add(time.Hour), "cooling off", 99)
+	if err == nil || err.Error() != ERROR_INVALIDSTATUS {
+		t.FailNow()
+	}
+
+	user, err := dbGetUserByIDNotArchived(db, 1)
+	if err != nil || user.Status.Int64 != STATUS_BANNED {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestAccountDeletion(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var selector, token string
+	sendCancel := func(s string, tk string) error {
+		selector, token = s, tk
+		return nil
+	}
+
+	err = RequestAccountDeletion(db, 1, "battery-staple-17", sendCancel)
+	if err == nil || err.Error() != ERROR_INVALIDPASSWORD {
+		t.FailNow()
+	}
+
+	err = RequestAccountDeletion(db, 1, "correct-horse-42", sendCancel)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err == nil {
+		t.FailNow()
+	}
+
+	err = CancelAccountDeletion(db, selector, "wrong")
+	if err == nil || err.Error() != ERROR_INVALIDTOKEN {
+		t.FailNow()
+	}
+
+	err = CancelAccountDeletion(db, selector, token)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = Login(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the link only works once
+	err = CancelAccountDeletion(db, selector, token)
+	if err == nil || err.Error() != ERROR_INVALIDSELECTOR {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestPurgeDeletedAccounts(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "jane.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var selector, token string
+	err = RequestAccountDeletion(db, 1, "correct-horse-42", func(s string, tk string) error {
+		selector, token = s, tk
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	purged, err := PurgeDeletedAccounts(db)
+	if err != nil || purged != 0 {
+		t.FailNow()
+	}
+
+	err = Invite(db, 1, "sam.doe@hotmail.com", ROLE_USER, func(s string, tk string) error {
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("INSERT INTO users_email_reverts (user_id, email, selector, token, expires) VALUES (1, 'j.doe@gmail.com', 'revertselector', 'x', 0)")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("INSERT INTO auth_outbox (recipient, subject, text_body, html_body, next_attempt, created) VALUES ('j.doe@gmail.com', 'Revert', 'x', 'x', 0, 0)")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("UPDATE users_deletions SET purge=0")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = CancelAccountDeletion(db, selector, token)
+	if err == nil || err.Error() != ERROR_TOKENEXPIRED {
+		t.FailNow()
+	}
+
+	purged, err = PurgeDeletedAccounts(db)
+	if err != nil || purged != 1 {
+		t.FailNow()
+	}
+
+	var count int64
+	err = db.Get(&count, "SELECT COUNT(*) FROM users WHERE id=1")
+	if err != nil || count != 0 {
+		t.FailNow()
+	}
+
+	for _, table := range []string{"users_deletions", "users_status_history", "users_audit"} {
+		err = db.Get(&count, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE user_id=1", table))
+		if err != nil {
+			t.Error(err)
+		}
+		if count != 0 {
+			t.Errorf("%s still holds rows of the purged user", table)
+		}
+	}
+
+	err = db.Get(&count, "SELECT COUNT(*) FROM auth_outbox WHERE recipient='j.doe@gmail.com'")
+	if err != nil || count != 0 {
+		t.FailNow()
+	}
+
+	err = db.Get(&count, "SELECT COUNT(*) FROM users_invitations WHERE inviter_id=0 AND email='sam.doe@hotmail.com'")
+	if err != nil || count != 1 {
+		t.FailNow()
+	}
+
+	_, err = Login(db, "jane.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = db.Close()
+}
+func TestExportUserData(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	var inviteToken string
+	err = Invite(db, 7, "j.doe@hotmail.com", ROLE_USER, func(s string, tk string) error {
+		inviteToken = tk
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	var token string
+	err = RegisterWithConfirmation(db, "j.doe@hotmail.com", "correct-horse-42", func(selector string, tk string) error {
+		token = tk
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("UPDATE users SET verified=1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	var rememberToken string
+	err = Remember(db, 1, getUserRememberedExpiry(), func(selector string, tk string) error {
+		rememberToken = tk
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ChangeUsername(db, 1, "jdoe")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = ChangeUsername(db, 1, "johnd")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("INSERT INTO users_reviews (user_id, reviewer_id, decision, reason, created) VALUES (1, 7, 'approved', 'looks fine', 1)")
+	if err != nil {
+		t.Error(err)
+	}
+
+	doc, err := ExportUserData(db, 1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var export map[string]interface{}
+	err = json.Unmarshal(doc, &export)
+	if err != nil {
+		t.Error(err)
+	}
+
+	account := export["account"].(map[string]interface{})
+	if account["email"] != "j.doe@hotmail.com" || account["password"] != "[redacted]" {
+		t.FailNow()
+	}
+
+	if len(export["confirmations"].([]interface{})) != 1 || len(export["remember_tokens"].([]interface{})) != 1 {
+		t.FailNow()
+	}
+
+	if len(export["reviews"].([]interface{})) != 1 || len(export["former_usernames"].([]interface{})) != 1 {
+		t.FailNow()
+	}
+
+	invitations := export["invitations"].([]interface{})
+	if len(invitations) != 1 || invitations[0].(map[string]interface{})["token"] != "[redacted]" {
+		t.FailNow()
+	}
+
+	if export["sessions"].(map[string]interface{})["force_logout"] == nil {
+		t.FailNow()
+	}
+
+	user, err := dbGetUserByID(db, 1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, secret := range []string{user.Password.String, token, rememberToken, inviteToken} {
+		if strings.Contains(string(doc), secret) {
+			t.Errorf("export holds secret %q", secret)
+		}
+	}
+
+	archive, err := ExportUserDataZip(db, 1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(r.File) != 1 || r.File[0].Name != "user-data.json" {
+		t.FailNow()
+	}
+
+	_, err = ExportUserData(db, 2)
+	if err == nil || err.Error() != ERROR_INVALIDUSERID {
+		t.FailNow()
+	}
+
+	_ = db.Close()
+}
+func TestPurgeExpired(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = Register(db, "j.doe@hotmail.com", "correct-horse-42")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("UPDATE users SET verified=1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err = dbCreateUserReset(db, NewUserReset(1, 1))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	_, err = dbCreateUserRemember(db, NewUserRemember(1, 1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = dbCreateUserRemember(db, NewUserRemember(1, getUserRememberedExpiry()))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// a reservation without an expiry is kept forever
+	_, err = db.Exec("INSERT INTO users_username_reservations (user_id, username_key, expires) VALUES (1, 'jdoe', 0), (1, 'johndoe', 1)")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// expired resets do not count against the limit
+	err = ResetPasswordWithConfirmation(db, "j.doe@hotmail.com", func(selector string, token string) error {
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	janitor := NewJanitor(db)
+	janitor.BatchSize = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = janitor.Purge(ctx)
+	if err != context.Canceled {
+		t.FailNow()
+	}
+
+	counts, err := janitor.Purge(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+
+	if counts["users_resets"] != 5 || counts["users_remembered"] != 1 || counts["users_confirmations"] != 0 || counts["users_username_reservations"] != 1 {
+		t.FailNow()
+	}
+
+	var count int64
+	err = db.Get(&count, "SELECT COUNT(*) FROM users_resets")
+	if err != nil || count != 1 {
+		t.FailNow()
+	}
+
+	err = db.Get(&count, "SELECT COUNT(*) FROM users_username_reservations WHERE username_key='jdoe'")
+	if err != nil || count != 1 {
+		t.FailNow()
+	}
+
+	_, err = dbCreateUserRemember(db, NewUserRemember(1, 1))
+	if err != nil {
+		t.Error(err)
+	}
+
+	janitor.BatchSize = 0
+	counts, err = janitor.Purge(context.Background())
+	if err != nil || counts["users_remembered"] != 1 {
+		t.FailNow()
+	}
+
+	counts, err = PurgeExpired(context.Background(), db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for table, deleted := range counts {
+		if deleted != 0 {
+			t.Errorf("%s: %d rows purged twice", table, deleted)
+		}
+	}
+
+	_ = db.Close()
+}
+func TestJanitorRun(t *testing.T) {
+	err := setup()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = db.Exec("DROP TABLE users_challenges")
+	if err != nil {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	failed := 0
+
+	janitor := NewJanitor(db)
+
+	err = janitor.Run(context.Background(), 0)
+	if err == nil || err.Error() != ERROR_INVALIDINTERVAL {
+		t.FailNow()
+	}
+
+	janitor.Report = func(counts map[string]int64, err error) {
+		if err == nil {
+			t.Error("purge of a missing table succeeded")
+		}
+		failed++
+		if failed == 2 {
+			cancel()
+		}
+	}
+
+	err = janitor.Run(ctx, time.Millisecond)
+	if err != nil || failed != 2 {
+		t.FailNow()
+	}
+
 	_ = db.Close()
 }
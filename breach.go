@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// BreachChecker reports how often a password appears in known breaches.
+type BreachChecker interface {
+	BreachCount(password string) (int64, error)
+}
+
+// The index is a header followed by fixed size records sorted by hash:
+// 20 bytes SHA-1 and a big endian uint32 breach count.
+const (
+	hibpIndexMagic      = "HIBPIDX1"
+	hibpIndexRecordSize = sha1.Size + 4
+)
+
+// HIBPIndex looks up passwords in an index built by BuildHIBPIndex from
+// the SHA-1 "ordered by hash" Have I Been Pwned dump.
+type HIBPIndex struct {
+	r       io.ReaderAt
+	records int64
+	closer  io.Closer
+}
+
+func NewHIBPIndex(r io.ReaderAt, size int64) (*HIBPIndex, error) {
+	header := make([]byte, len(hibpIndexMagic))
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+
+	if string(header) != hibpIndexMagic {
+		return nil, errors.New(ERROR_BADBREACHINDEX)
+	}
+
+	body := size - int64(len(hibpIndexMagic))
+	if body%hibpIndexRecordSize != 0 {
+		return nil, errors.New(ERROR_BADBREACHINDEX)
+	}
+
+	return &HIBPIndex{
+		r:       r,
+		records: body / hibpIndexRecordSize,
+	}, nil
+}
+func OpenHIBPIndex(path string) (*HIBPIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	index, err := NewHIBPIndex(f, info.Size())
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	index.closer = f
+
+	return index, nil
+}
+
+func (x *HIBPIndex) Close() error {
+	if x.closer == nil {
+		return nil
+	}
+	return x.closer.Close()
+}
+func (x *HIBPIndex) BreachCount(password string) (int64, error) {
+	hash := sha1.Sum([]byte(password))
+	record := make([]byte, hibpIndexRecordSize)
+
+	lo, hi := int64(0), x.records
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		offset := int64(len(hibpIndexMagic)) + mid*hibpIndexRecordSize
+		if _, err := x.r.ReadAt(record, offset); err != nil {
+			return -999, err
+		}
+
+		switch bytes.Compare(record[:sha1.Size], hash[:]) {
+		case 0:
+			return int64(binary.BigEndian.Uint32(record[sha1.Size:])), nil
+		case -1:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+
+	return 0, nil
+}
+
+// BuildHIBPIndex converts a dump of "HASH:COUNT" lines, sorted by hash,
+// into the binary index read by HIBPIndex. Lines with a count below
+// minCount are skipped to keep the index small.
+func BuildHIBPIndex(dump io.Reader, index io.Writer, minCount int64) (int64, error) {
+	w := bufio.NewWriter(index)
+	if _, err := w.WriteString(hibpIndexMagic); err != nil {
+		return -999, err
+	}
+
+	var written int64
+	var previous []byte
+	record := make([]byte, hibpIndexRecordSize)
+
+	scanner := bufio.NewScanner(dump)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 {
+			return -999, fmt.Errorf("line %d: expected HASH:COUNT", line)
+		}
+
+		hash, err := hex.DecodeString(parts[0])
+		if err != nil || len(hash) != sha1.Size {
+			return -999, fmt.Errorf("line %d: invalid SHA-1 hash", line)
+		}
+
+		count, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return -999, fmt.Errorf("line %d: invalid count", line)
+		}
+
+		if previous != nil && bytes.Compare(previous, hash) >= 0 {
+			return -999, fmt.Errorf("line %d: dump is not sorted by hash", line)
+		}
+		previous = hash
+
+		if count < minCount {
+			continue
+		}
+		if count > math.MaxUint32 {
+			count = math.MaxUint32
+		}
+
+		copy(record, hash)
+		binary.BigEndian.PutUint32(record[sha1.Size:], uint32(count))
+		if _, err := w.Write(record); err != nil {
+			return -999, err
+		}
+		written++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return -999, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return -999, err
+	}
+
+	return written, nil
+}
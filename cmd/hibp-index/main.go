@@ -0,0 +1,57 @@
+// Command hibp-index builds the binary breach index used by auth.HIBPIndex
+// from the SHA-1 "ordered by hash" Have I Been Pwned password dump.
+//
+//	hibp-index -in pwned-passwords-sha1-ordered-by-hash.txt -out hibp.idx
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/stockholmr/auth"
+	"os"
+)
+
+func main() {
+	in := flag.String("in", "", "HIBP dump, one HASH:COUNT per line sorted by hash")
+	out := flag.String("out", "hibp.idx", "index file to write")
+	minCount := flag.Int64("min-count", 1, "skip hashes seen fewer times than this")
+	flag.Parse()
+
+	if *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*in, *out, *minCount); err != nil {
+		fmt.Fprintln(os.Stderr, "hibp-index:", err)
+		os.Exit(1)
+	}
+}
+
+func run(in string, out string, minCount int64) error {
+	dump, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer dump.Close()
+
+	index, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+
+	written, err := auth.BuildHIBPIndex(dump, index, minCount)
+	if err != nil {
+		_ = index.Close()
+		_ = os.Remove(out)
+		return err
+	}
+
+	err = index.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("wrote %d hashes to %s\n", written, out)
+	return nil
+}
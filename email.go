@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	htmltemplate "html/template"
+	"io/fs"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+)
+
+//go:embed templates
+var defaultTemplates embed.FS
+
+// emailData is passed to every email template.
+type emailData struct {
+	Email  string
+	Link   string
+	Code   string
+	Reason string
+	Notice string
+}
+
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// EmailSender renders the built-in emails and hands them to a Mailer. Its
+// methods return callbacks for the flows in this package, for example
+//
+//	RegisterWithConfirmation(db, email, password, sender.Confirmation(email))
+//
+// Links are built from BaseURL and the path configured for each email.
+// Emails are rendered in Locale, see WithLocale.
+type EmailSender struct {
+	Mailer  Mailer
+	BaseURL string
+	Paths   map[string]string
+	Locale  string
+
+	// locale -> email name -> template
+	templates map[string]map[string]*emailTemplate
+}
+
+func NewEmailSender(mailer Mailer, baseURL string) *EmailSender {
+	s := &EmailSender{
+		Mailer:  mailer,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Paths: map[string]string{
+			EMAIL_CONFIRMATION: "/confirm-email",
+			EMAIL_RESET:        "/reset-password",
+			EMAIL_CHANGE:       "/confirm-email",
+			EMAIL_REVERT:       "/revert-email",
+			EMAIL_LOGIN_LINK:   "/login-link",
+			EMAIL_INVITATION:   "/accept-invitation",
+			EMAIL_DELETION:     "/cancel-deletion",
+		},
+		Locale:    DEFAULT_LOCALE,
+		templates: make(map[string]map[string]*emailTemplate),
+	}
+
+	sub, _ := fs.Sub(defaultTemplates, "templates")
+	// the embedded templates are known to parse
+	_ = s.LoadTemplates(sub)
+
+	return s
+}
+
+// LoadTemplates reads <locale>/<name>.txt and <locale>/<name>.html for every
+// email from fsys, replacing the built-in ones. The text template defines
+// the subject in a block named "subject". Emails with neither file in fsys
+// are left unchanged, an email with only one of them is an error.
+func (s *EmailSender) LoadTemplates(fsys fs.FS) error {
+	dirs, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		locale := normalizeLocale(dir.Name())
+
+		for _, name := range []string{EMAIL_CONFIRMATION, EMAIL_RESET, EMAIL_CHANGE, EMAIL_REVERT, EMAIL_NOTICE, EMAIL_LOGIN_LINK, EMAIL_CODE, EMAIL_INVITATION, EMAIL_REVIEW, EMAIL_DELETION} {
+			path := dir.Name() + "/" + name
+			_, textErr := fs.Stat(fsys, path+".txt")
+			_, htmlErr := fs.Stat(fsys, path+".html")
+			if errors.Is(textErr, fs.ErrNotExist) && errors.Is(htmlErr, fs.ErrNotExist) {
+				continue
+			}
+
+			text, err := texttemplate.ParseFS(fsys, path+".txt")
+			if err != nil {
+				return err
+			}
+
+			html, err := htmltemplate.ParseFS(fsys, path+".html")
+			if err != nil {
+				return err
+			}
+
+			if s.templates[locale] == nil {
+				s.templates[locale] = make(map[string]*emailTemplate)
+			}
+			s.templates[locale][name] = &emailTemplate{text: text, html: html}
+		}
+	}
+
+	return nil
+}
+
+// WithLocale returns a copy of s that renders emails in locale, for example
+// the one returned by GetUserLocale. Missing translations fall back to the
+// base language and then DEFAULT_LOCALE.
+func (s *EmailSender) WithLocale(locale string) *EmailSender {
+	c := *s
+	c.Locale = locale
+	return &c
+}
+
+func (s *EmailSender) Confirmation(email string) SelectorTokenCallBack {
+	return s.linkCallBack(EMAIL_CONFIRMATION, email, email)
+}
+func (s *EmailSender) Reset(email string) SelectorTokenCallBack {
+	return s.linkCallBack(EMAIL_RESET, email, email)
+}
+
+func (s *EmailSender) LoginLink(email string) SelectorTokenCallBack {
+	return s.linkCallBack(EMAIL_LOGIN_LINK, email, email)
+}
+
+// EmailChange is sent to the new address of RequestEmailChange.
+func (s *EmailSender) EmailChange(newEmail string) SelectorTokenCallBack {
+	return s.linkCallBack(EMAIL_CHANGE, newEmail, newEmail)
+}
+
+// EmailRevert is sent to the old address of RequestEmailChange.
+func (s *EmailSender) EmailRevert(oldEmail string) SelectorTokenCallBack {
+	return s.linkCallBack(EMAIL_REVERT, oldEmail, oldEmail)
+}
+
+// Invitation is sent by Invite.
+func (s *EmailSender) Invitation(email string) SelectorTokenCallBack {
+	return s.linkCallBack(EMAIL_INVITATION, email, email)
+}
+
+// Deletion is sent by RequestAccountDeletion.
+func (s *EmailSender) Deletion(email string) SelectorTokenCallBack {
+	return s.linkCallBack(EMAIL_DELETION, email, email)
+}
+
+// Code sends the one-time codes of RequestLoginCode and RequestResetCode.
+func (s *EmailSender) Code(email string) CodeCallBack {
+	return s.codeCallBack(email, email)
+}
+
+// Notice can be passed to SetEnumerationSafe.
+func (s *EmailSender) Notice() NoticeCallBack {
+	return func(email string, notice string) error {
+		return s.send(EMAIL_NOTICE, email, &emailData{Email: email, Notice: notice})
+	}
+}
+
+// Review can be passed to SetModeration.
+func (s *EmailSender) Review() ReviewCallBack {
+	return func(email string, decision string, reason string) error {
+		return s.send(EMAIL_REVIEW, email, &emailData{Email: email, Notice: decision, Reason: reason})
+	}
+}
+
+func (s *EmailSender) linkCallBack(name string, to string, email string) SelectorTokenCallBack {
+	cb := func(selector string, token string) error {
+		h := getOutboxHandle(selector)
+		if h != nil {
+			selector, token = h.selector, h.token
+		}
+
+		template := name
+		data := &emailData{Email: email}
+		// RegisterWithConfirmation in CONFIRMATION_CODE mode
+		if selector == "" {
+			template = EMAIL_CODE
+			data.Code = token
+		} else {
+			data.Link = s.link(name, selector, token)
+		}
+
+		if h != nil {
+			return s.queue(h, template, to, data)
+		}
+		return s.send(template, to, data)
+	}
+	registerEmailCallBack(cb)
+	return cb
+}
+func (s *EmailSender) codeCallBack(to string, email string) CodeCallBack {
+	cb := func(code string) error {
+		h := getOutboxHandle(code)
+		if h != nil {
+			code = h.token
+		}
+
+		data := &emailData{
+			Email: email,
+			Code:  code,
+		}
+
+		if h != nil {
+			return s.queue(h, EMAIL_CODE, to, data)
+		}
+		return s.send(EMAIL_CODE, to, data)
+	}
+	registerEmailCallBack(cb)
+	return cb
+}
+func (s *EmailSender) link(name string, selector string, token string) string {
+	query := url.Values{}
+	query.Set("selector", selector)
+	query.Set("token", token)
+	return s.BaseURL + s.Paths[name] + "?" + query.Encode()
+}
+func (s *EmailSender) send(name string, to string, data *emailData) error {
+	subject, text, html, err := s.render(name, data)
+	if err != nil {
+		return err
+	}
+	return s.Mailer.Send(to, subject, text, html)
+}
+
+// queue writes the email into the transaction of h when Mailer is an Outbox
+// and otherwise leaves it for the flow to send after committing.
+func (s *EmailSender) queue(h *outboxHandle, name string, to string, data *emailData) error {
+	if _, ok := s.Mailer.(*Outbox); !ok {
+		return nil
+	}
+
+	subject, text, html, err := s.render(name, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = dbTxCreateOutboxMessage(h.tx, NewOutboxMessage(to, subject, text, html))
+	if err != nil {
+		return err
+	}
+
+	h.queued = true
+	return nil
+}
+func (s *EmailSender) render(name string, data *emailData) (string, string, string, error) {
+	var t *emailTemplate
+	for _, l := range localeFallbacks(s.Locale) {
+		if t = s.templates[l][name]; t != nil {
+			break
+		}
+	}
+
+	if t == nil {
+		return "", "", "", errors.New(ERROR_NOTEMPLATE)
+	}
+
+	subject := new(bytes.Buffer)
+	if err := t.text.ExecuteTemplate(subject, "subject", data); err != nil {
+		return "", "", "", err
+	}
+
+	text := new(bytes.Buffer)
+	if err := t.text.Execute(text, data); err != nil {
+		return "", "", "", err
+	}
+
+	html := new(bytes.Buffer)
+	if err := t.html.Execute(html, data); err != nil {
+		return "", "", "", err
+	}
+
+	return strings.TrimSpace(subject.String()), text.String(), html.String(), nil
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"errors"
+	"golang.org/x/net/idna"
+	"strings"
+)
+
+// EmailProviderRule rewrites the local part of addresses at a provider that
+// delivers several spellings to the same mailbox.
+type EmailProviderRule func(local string) string
+
+// EmailNormalizer turns an address into the key accounts are looked up and
+// kept unique by. The address itself is stored as entered for display.
+//
+// The domain is always lowercased and converted to its ASCII (IDNA) form.
+// The local part is case-sensitive by the RFCs but not at any provider in
+// practice, so it is lowercased unless LowercaseLocalPart is turned off.
+type EmailNormalizer struct {
+	LowercaseLocalPart bool
+
+	// domain -> rule
+	providers map[string]EmailProviderRule
+	aliases   map[string]string
+}
+
+func NewEmailNormalizer() *EmailNormalizer {
+	return &EmailNormalizer{
+		LowercaseLocalPart: true,
+		providers:          make(map[string]EmailProviderRule),
+		aliases:            make(map[string]string),
+	}
+}
+
+// AddProviderRule applies rule to addresses at domain. Any aliases are
+// treated as the same domain, for example googlemail.com for gmail.com.
+func (n *EmailNormalizer) AddProviderRule(domain string, rule EmailProviderRule, aliases ...string) {
+	n.providers[domain] = rule
+	for _, alias := range aliases {
+		n.aliases[alias] = domain
+	}
+}
+
+// AddGmailRules ignores dots and "+tag" suffixes in Gmail addresses, so
+// J.Doe+news@googlemail.com and jdoe@gmail.com are one account.
+func (n *EmailNormalizer) AddGmailRules() {
+	n.AddProviderRule("gmail.com", GmailRule, "googlemail.com")
+}
+
+func (n *EmailNormalizer) Normalize(email string) (string, error) {
+	email = strings.TrimSpace(email)
+
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return "", errors.New(ERROR_INVALIDEMAIL)
+	}
+
+	local, domain := email[:at], email[at+1:]
+
+	domain, err := idna.Lookup.ToASCII(strings.TrimSuffix(domain, "."))
+	if err != nil {
+		return "", errors.New(ERROR_INVALIDEMAIL)
+	}
+	domain = strings.ToLower(domain)
+
+	if alias, ok := n.aliases[domain]; ok {
+		domain = alias
+	}
+
+	if n.LowercaseLocalPart {
+		local = strings.ToLower(local)
+	}
+
+	if rule, ok := n.providers[domain]; ok {
+		local = rule(local)
+	}
+
+	return local + "@" + domain, nil
+}
+
+func GmailRule(local string) string {
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	return strings.ReplaceAll(local, ".", "")
+}
+
+// NormalizeEmail returns the lookup key of email under the normalizer set
+// with SetEmailNormalizer.
+func NormalizeEmail(email string) (string, error) {
+	return getEmailNormalizer().Normalize(email)
+}
+
+// emailKey is NormalizeEmail for addresses that were already validated.
+func emailKey(email string) string {
+	key, err := NormalizeEmail(email)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(email))
+	}
+	return key
+}
@@ -0,0 +1,52 @@
+package auth
+
+import "sync"
+
+// NoticeCallBack tells the owner of email about an event that was hidden
+// from the caller, for example a registration attempt with their address.
+type NoticeCallBack func(email string, notice string) error
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// getDummyHash returns a hash that no password matches. Verifying against it
+// for unknown users makes a failed login take as long as for known users.
+func getDummyHash() string {
+	dummyHashOnce.Do(func() {
+		// 32 ASCII characters always fit bcrypt's limit
+		dummyHash, _ = hashPassword(randomString(32))
+	})
+	return dummyHash
+}
+
+// concealAccountError returns err unless enumeration-safe mode is enabled.
+// Then the owner of email is sent notice instead and nil is returned, so the
+// caller cannot tell the outcome apart from a success.
+func concealAccountError(email string, notice string, err error) error {
+	if !isEnumerationSafe() {
+		return err
+	}
+
+	if cb := getNoticeCallBack(); cb != nil {
+		// sent in the background, waiting for it would show in the response
+		// time and its failures must not reach the caller either
+		go func() {
+			_ = cb(email, notice)
+		}()
+	}
+
+	return nil
+}
+
+// concealUnknownAccount returns err unless enumeration-safe mode is enabled.
+// Then it spends the time a token would take to create and returns nil.
+func concealUnknownAccount(err error) error {
+	if !isEnumerationSafe() {
+		return err
+	}
+
+	_ = verifyHash(getDummyHash(), randomString(16))
+	return nil
+}
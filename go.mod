@@ -5,7 +5,9 @@ go 1.20
 require (
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/mattn/go-sqlite3 v1.14.17
-	golang.org/x/crypto v0.9.0
+	golang.org/x/crypto v0.11.0
+	golang.org/x/net v0.12.0
+	golang.org/x/text v0.13.0
 )
 
 require github.com/stockholmr/database v0.0.0-20230603143156-d7adc77fc943 // indirect
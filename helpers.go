@@ -3,11 +3,13 @@ package auth
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/jmoiron/sqlx"
 	"golang.org/x/crypto/bcrypt"
 	"math/rand"
 	"net/mail"
 	"regexp"
+	"strings"
 	"time"
 )
 
@@ -19,17 +21,37 @@ func ValidateAlphanumericString(s string) bool {
 	return matched
 }
 
-func hashPassword(pw string) string {
-	hash, _ := bcrypt.GenerateFromPassword([]byte(pw), 4)
-	return string(hash)
+func hashPassword(pw string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(normalizePassword(pw)), 4)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
 }
 func verifyHash(hash string, pw string) bool {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw)) == nil
+	normalized := normalizePassword(pw)
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(normalized)) == nil {
+		return true
+	}
+	// hashes created before normalization was introduced
+	return normalized != pw && bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw)) == nil
 }
 func validateEmail(email string) bool {
 	_, err := mail.ParseAddress(email)
+	if err != nil {
+		return false
+	}
+	_, err = NormalizeEmail(email)
 	return err == nil
 }
+func validatePhone(phone string) bool {
+	// E.164, for example +46701234567
+	matched, err := regexp.Match(`^\+[1-9][0-9]{6,14}$`, []byte(phone))
+	if err != nil {
+		return false
+	}
+	return matched
+}
 func randomString(length int64) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	random := rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -45,15 +67,29 @@ PRAGMA foreign_keys = OFF;
 CREATE TABLE "users" (
 	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
 	"email" VARCHAR(249) NOT NULL,
+	"email_key" VARCHAR(249) NOT NULL,
 	"password" VARCHAR(255) NOT NULL,
 	"status" INTEGER NOT NULL CHECK ("status" >= 0) DEFAULT "0",
+	"status_until" INTEGER NOT NULL CHECK ("status_until" >= 0) DEFAULT "0",
 	"verified" INTEGER NOT NULL CHECK ("verified" >= 0) DEFAULT "0",
 	"resettable" INTEGER NOT NULL CHECK ("resettable" >= 0) DEFAULT "1",
 	"roles_mask" INTEGER NOT NULL CHECK ("roles_mask" >= 0) DEFAULT "1",
 	"registered" INTEGER NOT NULL CHECK ("registered" >= 0),
 	"last_login" INTEGER CHECK ("last_login" >= 0) DEFAULT NULL,
 	"force_logout" INTEGER NOT NULL CHECK ("force_logout" >= 0) DEFAULT "0",
-	CONSTRAINT "email" UNIQUE ("email")
+	"password_changed_at" INTEGER CHECK ("password_changed_at" >= 0) DEFAULT NULL,
+	"must_change_password" INTEGER NOT NULL CHECK ("must_change_password" >= 0) DEFAULT "0",
+	"locale" VARCHAR(16) DEFAULT NULL,
+	"phone" VARCHAR(16) DEFAULT NULL,
+	"phone_verified" INTEGER NOT NULL CHECK ("phone_verified" >= 0) DEFAULT "0",
+	"phone_two_factor" INTEGER NOT NULL CHECK ("phone_two_factor" >= 0) DEFAULT "0",
+	"username" VARCHAR(64) DEFAULT NULL,
+	"username_key" VARCHAR(64) DEFAULT NULL,
+	"confirmation_sent" INTEGER NOT NULL CHECK ("confirmation_sent" >= 0) DEFAULT "0",
+	"confirmation_resends" INTEGER NOT NULL CHECK ("confirmation_resends" >= 0) DEFAULT "0",
+	CONSTRAINT "email" UNIQUE ("email"),
+	CONSTRAINT "email_key" UNIQUE ("email_key"),
+	CONSTRAINT "username_key" UNIQUE ("username_key")
 );
 CREATE TABLE "users_confirmations" (
 	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
@@ -62,6 +98,7 @@ CREATE TABLE "users_confirmations" (
 	"selector" VARCHAR(16) NOT NULL,
 	"token" VARCHAR(255) NOT NULL,
 	"expires" INTEGER NOT NULL CHECK ("expires" >= 0),
+	"created" INTEGER NOT NULL CHECK ("created" >= 0) DEFAULT "0",
 	CONSTRAINT "selector" UNIQUE ("selector")
 );
 CREATE INDEX "users_confirmations.email_expires" ON "users_confirmations" ("email", "expires");
@@ -86,6 +123,137 @@ CREATE TABLE "users_resets" (
 	CONSTRAINT "selector" UNIQUE ("selector")
 );
 CREATE INDEX "users_resets.user_expires" ON "users_resets" ("user", "expires");
+
+CREATE TABLE "users_email_reverts" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
+	"user_id" INTEGER NOT NULL CHECK ("user_id" >= 0),
+	"email" VARCHAR(249) NOT NULL,
+	"selector" VARCHAR(16) NOT NULL,
+	"token" VARCHAR(255) NOT NULL,
+	"expires" INTEGER NOT NULL CHECK ("expires" >= 0),
+	CONSTRAINT "selector" UNIQUE ("selector")
+);
+CREATE INDEX "users_email_reverts.user_id" ON "users_email_reverts" ("user_id");
+
+CREATE TABLE "users_password_history" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
+	"user_id" INTEGER NOT NULL CHECK ("user_id" >= 0),
+	"password" VARCHAR(255) NOT NULL,
+	"created" INTEGER NOT NULL CHECK ("created" >= 0)
+);
+CREATE INDEX "users_password_history.user_id" ON "users_password_history" ("user_id");
+
+CREATE TABLE "users_audit" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
+	"user_id" INTEGER NOT NULL CHECK ("user_id" >= 0),
+	"event" VARCHAR(64) NOT NULL,
+	"created" INTEGER NOT NULL CHECK ("created" >= 0)
+);
+CREATE INDEX "users_audit.user_id" ON "users_audit" ("user_id");
+
+CREATE TABLE "auth_outbox" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
+	"recipient" VARCHAR(249) NOT NULL,
+	"subject" VARCHAR(255) NOT NULL,
+	"text_body" TEXT NOT NULL,
+	"html_body" TEXT NOT NULL,
+	"status" INTEGER NOT NULL CHECK ("status" >= 0) DEFAULT "0",
+	"attempts" INTEGER NOT NULL CHECK ("attempts" >= 0) DEFAULT "0",
+	"next_attempt" INTEGER NOT NULL CHECK ("next_attempt" >= 0),
+	"last_error" TEXT DEFAULT NULL,
+	"created" INTEGER NOT NULL CHECK ("created" >= 0),
+	"sent" INTEGER CHECK ("sent" >= 0) DEFAULT NULL
+);
+CREATE INDEX "auth_outbox.status_next_attempt" ON "auth_outbox" ("status", "next_attempt");
+
+CREATE TABLE "users_login_links" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
+	"user_id" INTEGER NOT NULL CHECK ("user_id" >= 0),
+	"selector" VARCHAR(16) NOT NULL,
+	"token" VARCHAR(255) NOT NULL,
+	"expires" INTEGER NOT NULL CHECK ("expires" >= 0),
+	CONSTRAINT "selector" UNIQUE ("selector")
+);
+CREATE INDEX "users_login_links.user_id" ON "users_login_links" ("user_id");
+
+CREATE TABLE "users_challenges" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
+	"user_id" INTEGER NOT NULL CHECK ("user_id" >= 0),
+	"selector" VARCHAR(16) NOT NULL,
+	"token" VARCHAR(255) NOT NULL,
+	"expires" INTEGER NOT NULL CHECK ("expires" >= 0),
+	CONSTRAINT "selector" UNIQUE ("selector")
+);
+CREATE INDEX "users_challenges.user_id" ON "users_challenges" ("user_id");
+
+CREATE TABLE "users_codes" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
+	"user_id" INTEGER NOT NULL CHECK ("user_id" >= 0),
+	"purpose" VARCHAR(16) NOT NULL,
+	"recipient" VARCHAR(249) NOT NULL,
+	"code" VARCHAR(255) NOT NULL,
+	"attempts" INTEGER NOT NULL CHECK ("attempts" >= 0) DEFAULT "0",
+	"expires" INTEGER NOT NULL CHECK ("expires" >= 0),
+	"issues" INTEGER NOT NULL CHECK ("issues" >= 0) DEFAULT "1",
+	"sent" INTEGER NOT NULL CHECK ("sent" >= 0),
+	"window_ends" INTEGER NOT NULL CHECK ("window_ends" >= 0)
+);
+CREATE INDEX "users_codes.user_id_purpose" ON "users_codes" ("user_id", "purpose");
+
+CREATE TABLE "users_invitations" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
+	"inviter_id" INTEGER NOT NULL CHECK ("inviter_id" >= 0),
+	"email" VARCHAR(249) NOT NULL,
+	"email_key" VARCHAR(249) NOT NULL,
+	"roles_mask" INTEGER NOT NULL CHECK ("roles_mask" >= 0) DEFAULT "1",
+	"selector" VARCHAR(16) NOT NULL,
+	"token" VARCHAR(255) NOT NULL,
+	"expires" INTEGER NOT NULL CHECK ("expires" >= 0),
+	"created" INTEGER NOT NULL CHECK ("created" >= 0),
+	CONSTRAINT "selector" UNIQUE ("selector")
+);
+CREATE INDEX "users_invitations.email_key" ON "users_invitations" ("email_key");
+
+CREATE TABLE "users_reviews" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
+	"user_id" INTEGER NOT NULL CHECK ("user_id" >= 0),
+	"reviewer_id" INTEGER NOT NULL CHECK ("reviewer_id" >= 0),
+	"decision" VARCHAR(16) NOT NULL,
+	"reason" TEXT NOT NULL,
+	"created" INTEGER NOT NULL CHECK ("created" >= 0)
+);
+CREATE INDEX "users_reviews.user_id" ON "users_reviews" ("user_id");
+
+CREATE TABLE "users_status_history" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
+	"user_id" INTEGER NOT NULL CHECK ("user_id" >= 0),
+	"status" INTEGER NOT NULL CHECK ("status" >= 0),
+	"reason" TEXT NOT NULL,
+	"actor_id" INTEGER NOT NULL CHECK ("actor_id" >= 0),
+	"until" INTEGER NOT NULL CHECK ("until" >= 0),
+	"created" INTEGER NOT NULL CHECK ("created" >= 0)
+);
+CREATE INDEX "users_status_history.user_id" ON "users_status_history" ("user_id");
+
+CREATE TABLE "users_deletions" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
+	"user_id" INTEGER NOT NULL CHECK ("user_id" >= 0),
+	"selector" VARCHAR(16) NOT NULL,
+	"token" VARCHAR(255) NOT NULL,
+	"purge" INTEGER NOT NULL CHECK ("purge" >= 0),
+	"created" INTEGER NOT NULL CHECK ("created" >= 0),
+	CONSTRAINT "selector" UNIQUE ("selector"),
+	CONSTRAINT "user_id" UNIQUE ("user_id")
+);
+CREATE INDEX "users_deletions.purge" ON "users_deletions" ("purge");
+
+CREATE TABLE "users_username_reservations" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL CHECK ("id" >= 0),
+	"user_id" INTEGER NOT NULL CHECK ("user_id" >= 0),
+	"username_key" VARCHAR(64) NOT NULL,
+	"expires" INTEGER NOT NULL CHECK ("expires" >= 0),
+	CONSTRAINT "username_key" UNIQUE ("username_key")
+);
 `
 	_, err := db.Exec(cmd)
 	if err != nil {
@@ -95,6 +263,69 @@ CREATE INDEX "users_resets.user_expires" ON "users_resets" ("user", "expires");
 	return nil
 
 }
+
+// MigrateEmailKeys upgrades a users table created before accounts were
+// looked up by email key: it adds the email_key column if it is missing and
+// fills in the key of every account from its address. Run it once after
+// upgrading, and again after changing the email normalizer, before serving
+// requests. Two accounts whose addresses share a key make it fail; they have
+// to be merged by hand first.
+func MigrateEmailKeys(db *sqlx.DB) error {
+	if err := checkDatabase(db); err != nil {
+		return err
+	}
+
+	table := getTable("users")
+
+	var count int64
+	err := db.Get(&count, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?", table, "email_key")
+	if err != nil {
+		return err
+	}
+	missing := count == 0
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if missing {
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN \"email_key\" VARCHAR(249) NOT NULL DEFAULT \"\"", table))
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	users := make([]struct {
+		ID    int64  `db:"id"`
+		Email string `db:"email"`
+	}, 0)
+	err = tx.Select(&users, fmt.Sprintf("SELECT id, email FROM `%s`", table))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	for _, u := range users {
+		_, err = tx.Exec(fmt.Sprintf("UPDATE `%s` SET email_key=? WHERE id=?", table), emailKey(u.Email), u.ID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	// created with the column, the table already has the constraint
+	if missing {
+		_, err = tx.Exec(fmt.Sprintf("CREATE UNIQUE INDEX \"%s.email_key\" ON `%s` (\"email_key\")", table, table))
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
 func checkDatabase(db *sqlx.DB) error {
 	if db == nil {
 		return errors.New(ERROR_NODATABASECONN)
@@ -108,11 +339,25 @@ func checkDatabase(db *sqlx.DB) error {
 func createTokenAuthenticator() (string, string, string) {
 	selector := randomString(16)
 	token := randomString(16)
-	tokenHash := hashPassword(token)
+	// 16 ASCII characters always fit bcrypt's limit
+	tokenHash, _ := hashPassword(token)
 
 	return selector, token, tokenHash
 }
 
+// txInsert inserts one row inside tx and returns its id.
+func txInsert(tx *sqlx.Tx, table string, columns []string, values ...interface{}) (int64, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	cmd := fmt.Sprintf("INSERT INTO `%s` (%s) VALUES (%s)", table, strings.Join(columns, ", "), placeholders)
+
+	result, err := tx.Exec(cmd, values...)
+	if err != nil {
+		return -999, err
+	}
+
+	return result.LastInsertId()
+}
+
 func newNullString(v string) *sql.NullString {
 	return &sql.NullString{String: v, Valid: true}
 }
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+//go:embed locales/*.json
+var defaultLocales embed.FS
+
+// Catalog holds user-facing texts per locale, keyed by message ID. The IDs
+// are the ERROR_* values, the PASSWORD_RULE_* IDs and the MESSAGE_* IDs, so
+// an error returned by this package can be shown to a user with
+//
+//	LocalizeError(locale, err)
+type Catalog struct {
+	messages map[string]map[string]string
+}
+
+func NewCatalog() *Catalog {
+	c := &Catalog{
+		messages: make(map[string]map[string]string),
+	}
+
+	sub, _ := fs.Sub(defaultLocales, "locales")
+	// the embedded catalogs are known to parse
+	_ = c.LoadFS(sub)
+
+	return c
+}
+
+// LoadFS reads one <locale>.json file per locale from the top level of fsys,
+// each a JSON object mapping message IDs to texts. Texts are merged into
+// the ones already loaded.
+func (c *Catalog) LoadFS(fsys fs.FS) error {
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+
+		messages := make(map[string]string)
+		err = json.Unmarshal(data, &messages)
+		if err != nil {
+			return err
+		}
+
+		c.Add(strings.TrimSuffix(path.Base(file), ".json"), messages)
+	}
+
+	return nil
+}
+func (c *Catalog) Add(locale string, messages map[string]string) {
+	locale = normalizeLocale(locale)
+	if c.messages[locale] == nil {
+		c.messages[locale] = make(map[string]string)
+	}
+	for id, text := range messages {
+		c.messages[locale][id] = text
+	}
+}
+
+// Message returns the text for id in locale, falling back to the base
+// language ("sv" for "sv-SE") and then DEFAULT_LOCALE. Unknown IDs are
+// returned unchanged.
+func (c *Catalog) Message(locale string, id string) string {
+	for _, l := range localeFallbacks(locale) {
+		if text, ok := c.messages[l][id]; ok {
+			return text
+		}
+	}
+	return id
+}
+func (c *Catalog) Error(locale string, err error) string {
+	return c.Message(locale, err.Error())
+}
+
+func LocalizeMessage(locale string, id string) string {
+	return getCatalog().Message(locale, id)
+}
+func LocalizeError(locale string, err error) string {
+	return getCatalog().Error(locale, err)
+}
+
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+func localeFallbacks(locale string) []string {
+	locale = normalizeLocale(locale)
+	fallbacks := make([]string, 0, 3)
+	if locale != "" {
+		fallbacks = append(fallbacks, locale)
+	}
+	if i := strings.Index(locale, "-"); i > 0 {
+		fallbacks = append(fallbacks, locale[:i])
+	}
+	return append(fallbacks, DEFAULT_LOCALE)
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// expiringTables lists the tables whose rows are useless once the time in
+// their column has passed. Where keepZero is set, a zero time means the
+// row never expires.
+var expiringTables = []struct {
+	name     string
+	column   string
+	keepZero bool
+}{
+	{"users_confirmations", "expires", false},
+	{"users_remembered", "expires", false},
+	{"users_resets", "expires", false},
+	{"users_email_reverts", "expires", false},
+	{"users_login_links", "expires", false},
+	// an expired code still counts attempts until its window ends
+	{"users_codes", "window_ends", false},
+	{"users_challenges", "expires", false},
+	{"users_invitations", "expires", false},
+	{"users_username_reservations", "expires", true},
+}
+
+// Janitor deletes expired confirmations, remember tokens, resets and the
+// other short-lived rows of this package. Rows are deleted BatchSize at a
+// time so a large backlog never holds long locks; a BatchSize of zero or
+// less means 500.
+type Janitor struct {
+	BatchSize int64
+
+	// Report, when set, receives the counts of every purge done by Run and
+	// the error that ended it, if any.
+	Report func(counts map[string]int64, err error)
+
+	db *sqlx.DB
+}
+
+func NewJanitor(db *sqlx.DB) *Janitor {
+	return &Janitor{
+		BatchSize: 500,
+		db:        db,
+	}
+}
+
+// PurgeExpired deletes every expired row with a default Janitor and returns
+// how many were deleted per table.
+func PurgeExpired(ctx context.Context, db *sqlx.DB) (map[string]int64, error) {
+	return NewJanitor(db).Purge(ctx)
+}
+
+// Purge deletes every expired row and returns how many were deleted per
+// table. When ctx is cancelled it stops after the current batch and returns
+// the counts so far together with the context's error.
+func (j *Janitor) Purge(ctx context.Context) (map[string]int64, error) {
+	if err := checkDatabase(j.db); err != nil {
+		return nil, err
+	}
+
+	batchSize := j.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+
+	now := time.Now().Unix()
+	counts := make(map[string]int64, len(expiringTables))
+	for _, table := range expiringTables {
+		counts[table.name] = 0
+		for {
+			if err := ctx.Err(); err != nil {
+				return counts, err
+			}
+
+			deleted, err := dbDeleteExpiredBatch(j.db, table.name, table.column, table.keepZero, now, batchSize)
+			if err != nil {
+				return counts, err
+			}
+
+			counts[table.name] += deleted
+			if deleted < batchSize {
+				break
+			}
+		}
+	}
+
+	return counts, nil
+}
+
+// Run purges every interval until ctx is cancelled. A purge in progress
+// finishes its current batch before Run returns. A failed purge is handed
+// to Report and the next tick tries again. The interval must be positive.
+func (j *Janitor) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New(ERROR_INVALIDINTERVAL)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		counts, err := j.Purge(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if j.Report != nil {
+			j.Report(counts, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func dbDeleteExpiredBatch(db *sqlx.DB, table string, column string, keepZero bool, now int64, limit int64) (int64, error) {
+	where := fmt.Sprintf("`%s`<?", column)
+	if keepZero {
+		where = fmt.Sprintf("`%s`>0 AND %s", column, where)
+	}
+
+	cmd := fmt.Sprintf("SELECT id FROM `%s` WHERE %s ORDER BY id LIMIT ?", getTable(table), where)
+
+	ids := make([]int64, 0)
+	err := db.Select(&ids, cmd, now, limit)
+	if err != nil {
+		return -999, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	cmd, args, err := sqlx.In(fmt.Sprintf("DELETE FROM `%s` WHERE id IN (?)", getTable(table)), ids)
+	if err != nil {
+		return -999, err
+	}
+
+	result, err := db.Exec(db.Rebind(cmd), args...)
+	if err != nil {
+		return -999, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mailer delivers a single email with a plain text and an HTML body.
+type Mailer interface {
+	Send(to string, subject string, text string, html string) error
+}
+
+type SMTPMailer struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+}
+
+func NewSMTPMailer(addr string, auth smtp.Auth, from string) *SMTPMailer {
+	return &SMTPMailer{
+		Addr: addr,
+		Auth: auth,
+		From: from,
+	}
+}
+
+func (m *SMTPMailer) Send(to string, subject string, text string, html string) error {
+	msg, err := buildMessage(m.From, to, subject, text, html)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, msg)
+}
+
+// FileMailer writes every email as an .eml file to Dir instead of sending
+// it, for development and tests.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func NewFileMailer(dir string, from string) *FileMailer {
+	return &FileMailer{
+		Dir:  dir,
+		From: from,
+	}
+}
+
+func (m *FileMailer) Send(to string, subject string, text string, html string) error {
+	msg, err := buildMessage(m.From, to, subject, text, html)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(m.Dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.ReplaceAll(to, "/", "_"))
+	return os.WriteFile(filepath.Join(m.Dir, name), msg, 0o644)
+}
+
+func buildMessage(from string, to string, subject string, text string, html string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	body := multipart.NewWriter(buf)
+
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", to)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", body.Boundary())
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	}
+	for _, p := range parts {
+		if p.content == "" {
+			continue
+		}
+
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", p.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+		w, err := body.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(p.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
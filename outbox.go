@@ -0,0 +1,432 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/stockholmr/database"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type OutboxMessage struct {
+	ID          *sql.NullInt64  `db:"id"`
+	Recipient   *sql.NullString `db:"recipient"`
+	Subject     *sql.NullString `db:"subject"`
+	TextBody    *sql.NullString `db:"text_body"`
+	HTMLBody    *sql.NullString `db:"html_body"`
+	Status      *sql.NullInt64  `db:"status"`
+	Attempts    *sql.NullInt64  `db:"attempts"`
+	NextAttempt *sql.NullInt64  `db:"next_attempt"`
+	LastError   *sql.NullString `db:"last_error"`
+	Created     *sql.NullInt64  `db:"created"`
+	Sent        *sql.NullInt64  `db:"sent"`
+}
+
+func NewOutboxMessage(to string, subject string, text string, html string) *OutboxMessage {
+	now := time.Now().Unix()
+	return &OutboxMessage{
+		Recipient:   newNullString(to),
+		Subject:     newNullString(subject),
+		TextBody:    newNullString(text),
+		HTMLBody:    newNullString(html),
+		Status:      newNullInt64(OUTBOX_PENDING),
+		Attempts:    newNullInt64(0),
+		NextAttempt: newNullInt64(now),
+		Created:     newNullInt64(now),
+	}
+}
+
+func (m *OutboxMessage) GetID() int64 {
+	return m.ID.Int64
+}
+func (m *OutboxMessage) IsDead() bool {
+	return m.Status.Valid && m.Status.Int64 == OUTBOX_DEAD
+}
+
+// Outbox stores emails in the auth_outbox table and delivers them through
+// Mailer from a background dispatcher. Used as the Mailer of an EmailSender,
+// the emails of the flows in this package are written in the same
+// transaction as their token, so a crash or a failing mail server can
+// neither lose a committed email nor keep a rolled back one. The Outbox must
+// use the same database as the flows.
+//
+// Several dispatchers may share a database. Each email is claimed for Lease
+// before it is sent and only goes out again if its dispatcher died before
+// recording the result.
+type Outbox struct {
+	Mailer      Mailer
+	MaxAttempts int64
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	BatchSize   int64
+	Lease       time.Duration
+
+	// OnError is told about dispatch errors in Run, which keeps running.
+	OnError func(err error)
+
+	db *sqlx.DB
+}
+
+func NewOutbox(db *sqlx.DB, mailer Mailer) *Outbox {
+	return &Outbox{
+		Mailer:      mailer,
+		MaxAttempts: 8,
+		BaseBackoff: 30 * time.Second,
+		MaxBackoff:  time.Hour,
+		BatchSize:   50,
+		Lease:       5 * time.Minute,
+		db:          db,
+	}
+}
+
+// Send queues an email outside of any transaction.
+func (o *Outbox) Send(to string, subject string, text string, html string) error {
+	if err := checkDatabase(o.db); err != nil {
+		return err
+	}
+
+	_, err := dbCreateOutboxMessage(o.db, NewOutboxMessage(to, subject, text, html))
+	return err
+}
+
+// Run dispatches due emails every interval until ctx is cancelled. Errors
+// are handed to OnError and the next tick tries again.
+func (o *Outbox) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New(ERROR_INVALIDINTERVAL)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_, err := o.Dispatch()
+		if err != nil && o.OnError != nil {
+			o.OnError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Dispatch sends one batch of due emails and returns how many were sent.
+// Failed emails are retried with exponential backoff and dead-lettered
+// after MaxAttempts.
+func (o *Outbox) Dispatch() (int64, error) {
+	if err := checkDatabase(o.db); err != nil {
+		return -999, err
+	}
+
+	messages, err := dbGetOutboxMessagesDue(o.db, time.Now().Unix(), o.BatchSize)
+	if err != nil {
+		return -999, err
+	}
+
+	var sent int64
+	for _, m := range messages {
+		now := time.Now()
+		claimed, err := dbClaimOutboxMessage(o.db, m.GetID(), now.Unix(), now.Add(o.Lease).Unix())
+		if err != nil {
+			return sent, err
+		}
+		if !claimed {
+			// taken by another dispatcher
+			continue
+		}
+
+		sendErr := o.Mailer.Send(m.Recipient.String, m.Subject.String, m.TextBody.String, m.HTMLBody.String)
+		if sendErr == nil {
+			// the bodies hold live tokens, so they are not kept once delivered
+			err = dbUpdateOutboxMessage(
+				o.db,
+				m.GetID(),
+				database.NewFieldValuePairCollection(
+					database.NewFieldValuePair("status", OUTBOX_SENT),
+					database.NewFieldValuePair("text_body", ""),
+					database.NewFieldValuePair("html_body", ""),
+					database.NewFieldValuePair("sent", time.Now().Unix()),
+				),
+			)
+			if err != nil {
+				return sent, err
+			}
+			sent++
+			continue
+		}
+
+		attempts := m.Attempts.Int64 + 1
+		status := OUTBOX_PENDING
+		if attempts >= o.MaxAttempts {
+			status = OUTBOX_DEAD
+		}
+
+		err = dbUpdateOutboxMessage(
+			o.db,
+			m.GetID(),
+			database.NewFieldValuePairCollection(
+				database.NewFieldValuePair("status", status),
+				database.NewFieldValuePair("attempts", attempts),
+				database.NewFieldValuePair("next_attempt", time.Now().Add(o.backoff(attempts)).Unix()),
+				database.NewFieldValuePair("last_error", sendErr.Error()),
+			),
+		)
+		if err != nil {
+			return sent, err
+		}
+	}
+
+	return sent, nil
+}
+
+// DeadLetters returns the emails that ran out of attempts.
+func (o *Outbox) DeadLetters() ([]*OutboxMessage, error) {
+	if err := checkDatabase(o.db); err != nil {
+		return nil, err
+	}
+	return dbGetOutboxMessagesByStatus(o.db, OUTBOX_DEAD)
+}
+
+// Replay queues a dead-lettered email again with a fresh set of attempts.
+// Emails that are not dead-lettered are left alone.
+func (o *Outbox) Replay(id int64) error {
+	if err := checkDatabase(o.db); err != nil {
+		return err
+	}
+
+	replayed, err := dbReplayOutboxMessage(o.db, id, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	if !replayed {
+		return errors.New(ERROR_NOTDEADLETTER)
+	}
+
+	return nil
+}
+
+func (o *Outbox) backoff(attempts int64) time.Duration {
+	d := o.BaseBackoff
+	for i := int64(1); i < attempts && d < o.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.MaxBackoff {
+		d = o.MaxBackoff
+	}
+	return d
+}
+
+// Before committing, a flow hands its token to txQueueCallBack. A callback
+// made by an EmailSender is called with a staging handle in place of the
+// selector, looks the handle up and, when its Mailer is an Outbox, writes
+// its email through the handle's transaction. Any other callback is never
+// called inside a transaction; the flow calls it once it has committed.
+var outboxStage = struct {
+	sync.Mutex
+	callBacks map[uintptr]bool
+	handles   map[string]*outboxHandle
+	next      int64
+}{
+	callBacks: make(map[uintptr]bool),
+	handles:   make(map[string]*outboxHandle),
+}
+
+type outboxHandle struct {
+	tx       *sqlx.Tx
+	selector string
+	token    string
+	queued   bool
+}
+
+// registerEmailCallBack marks callbacks made by the same function literal
+// as cb as safe to call inside a transaction.
+func registerEmailCallBack(cb interface{}) {
+	outboxStage.Lock()
+	defer outboxStage.Unlock()
+	outboxStage.callBacks[reflect.ValueOf(cb).Pointer()] = true
+}
+func isEmailCallBack(cb interface{}) bool {
+	outboxStage.Lock()
+	defer outboxStage.Unlock()
+	return outboxStage.callBacks[reflect.ValueOf(cb).Pointer()]
+}
+func openOutboxHandle(tx *sqlx.Tx, selector string, token string) (string, *outboxHandle) {
+	outboxStage.Lock()
+	defer outboxStage.Unlock()
+	outboxStage.next++
+	key := fmt.Sprintf("outbox-stage-%d", outboxStage.next)
+	h := &outboxHandle{tx: tx, selector: selector, token: token}
+	outboxStage.handles[key] = h
+	return key, h
+}
+func closeOutboxHandle(key string) {
+	outboxStage.Lock()
+	defer outboxStage.Unlock()
+	delete(outboxStage.handles, key)
+}
+func getOutboxHandle(key string) *outboxHandle {
+	outboxStage.Lock()
+	defer outboxStage.Unlock()
+	return outboxStage.handles[key]
+}
+
+// txQueueCallBack writes the email cb would send into tx and reports
+// whether it did. When it did not, the flow calls cb after committing.
+func txQueueCallBack(tx *sqlx.Tx, cb SelectorTokenCallBack, selector string, token string) (bool, error) {
+	if !isEmailCallBack(cb) {
+		return false, nil
+	}
+
+	key, h := openOutboxHandle(tx, selector, token)
+	defer closeOutboxHandle(key)
+
+	err := cb(key, "")
+	return h.queued, err
+}
+
+// txQueueCodeCallBack is txQueueCallBack for codes.
+func txQueueCodeCallBack(tx *sqlx.Tx, cb CodeCallBack, code string) (bool, error) {
+	if !isEmailCallBack(cb) {
+		return false, nil
+	}
+
+	key, h := openOutboxHandle(tx, "", code)
+	defer closeOutboxHandle(key)
+
+	err := cb(key)
+	return h.queued, err
+}
+
+func dbCreateOutboxMessage(db *sqlx.DB, m *OutboxMessage) (int64, error) {
+	id, err := database.Insert(
+		db,
+		getTable("auth_outbox"),
+		database.NewFieldValuePairCollection(
+			database.NewFieldValuePair("recipient", m.Recipient),
+			database.NewFieldValuePair("subject", m.Subject),
+			database.NewFieldValuePair("text_body", m.TextBody),
+			database.NewFieldValuePair("html_body", m.HTMLBody),
+			database.NewFieldValuePair("status", m.Status),
+			database.NewFieldValuePair("attempts", m.Attempts),
+			database.NewFieldValuePair("next_attempt", m.NextAttempt),
+			database.NewFieldValuePair("created", m.Created),
+		),
+	)
+	if err != nil {
+		return -999, err
+	}
+
+	return id.Int64, nil
+}
+func dbTxCreateOutboxMessage(tx *sqlx.Tx, m *OutboxMessage) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("auth_outbox"),
+		[]string{"recipient", "subject", "text_body", "html_body", "status", "attempts", "next_attempt", "created"},
+		m.Recipient,
+		m.Subject,
+		m.TextBody,
+		m.HTMLBody,
+		m.Status,
+		m.Attempts,
+		m.NextAttempt,
+		m.Created,
+	)
+}
+func dbUpdateOutboxMessage(db *sqlx.DB, id int64, fields []*database.FieldValuePair) error {
+	err := database.Update(
+		db,
+		getTable("auth_outbox"),
+		fields,
+		database.NewFieldValuePair("id", id),
+	)
+	return err
+}
+func dbGetOutboxMessagesDue(db *sqlx.DB, now int64, limit int64) ([]*OutboxMessage, error) {
+	cmd := fmt.Sprintf(
+		"SELECT * FROM `%s` WHERE status IN (?, ?) AND next_attempt<=? ORDER BY id LIMIT ?",
+		getTable("auth_outbox"),
+	)
+	// emails still sending after their lease belong to a dispatcher that died
+	return dbQueryOutboxMessages(db, cmd, OUTBOX_PENDING, OUTBOX_SENDING, now, limit)
+}
+
+// dbClaimOutboxMessage marks the email as sending until leaseUntil and
+// reports whether this call claimed it.
+func dbClaimOutboxMessage(db *sqlx.DB, id int64, now int64, leaseUntil int64) (bool, error) {
+	cmd := fmt.Sprintf(
+		"UPDATE `%s` SET status=?, next_attempt=? WHERE id=? AND status IN (?, ?) AND next_attempt<=?",
+		getTable("auth_outbox"),
+	)
+	result, err := db.Exec(cmd, OUTBOX_SENDING, leaseUntil, id, OUTBOX_PENDING, OUTBOX_SENDING, now)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+func dbReplayOutboxMessage(db *sqlx.DB, id int64, now int64) (bool, error) {
+	cmd := fmt.Sprintf(
+		"UPDATE `%s` SET status=?, attempts=0, next_attempt=? WHERE id=? AND status=?",
+		getTable("auth_outbox"),
+	)
+	result, err := db.Exec(cmd, OUTBOX_PENDING, now, id, OUTBOX_DEAD)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+func dbGetOutboxMessagesByStatus(db *sqlx.DB, status int64) ([]*OutboxMessage, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE status=? ORDER BY id", getTable("auth_outbox"))
+	return dbQueryOutboxMessages(db, cmd, status)
+}
+func dbQueryOutboxMessages(db *sqlx.DB, cmd string, args ...interface{}) ([]*OutboxMessage, error) {
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Queryx(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	strArr := make([]*OutboxMessage, 0)
+	for rows.Next() {
+		str := new(OutboxMessage)
+		err = rows.StructScan(str)
+		if err != nil {
+			return nil, err
+		}
+		strArr = append(strArr, str)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return strArr, nil
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"bufio"
+	_ "embed"
+	"golang.org/x/text/unicode/norm"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+//go:embed common_passwords.txt
+var commonPasswords string
+
+// bcrypt rejects longer input, and non-ASCII characters take several bytes
+const maxPasswordBytes = 72
+
+// PasswordRuleFunc reports whether password satisfies a rule. email is the
+// address of the account the password belongs to and may be empty.
+type PasswordRuleFunc func(password string, email string) bool
+
+type PasswordRule struct {
+	ID    string
+	Check PasswordRuleFunc
+}
+
+// PasswordPolicy follows NIST 800-63B: length limits counted in characters
+// after NFKC normalization, no composition rules, and a blocklist of known
+// weak passwords. Custom rules are checked after the built-in ones. Whatever
+// MaxLength says, a password may not exceed the 72 bytes bcrypt accepts.
+//
+// When Breaches is set, passwords seen in at least BreachThreshold breaches
+// are rejected as well.
+type PasswordPolicy struct {
+	MinLength            int
+	MaxLength            int
+	RejectEmailLocalPart bool
+	Rules                []*PasswordRule
+	Breaches             BreachChecker
+	BreachThreshold      int64
+
+	blocklist map[string]struct{}
+}
+
+// PasswordPolicyError lists the IDs of every rule a password failed.
+type PasswordPolicyError struct {
+	Violations []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return ERROR_PASSWORDPOLICY
+}
+func (e *PasswordPolicyError) Has(ruleID string) bool {
+	for _, v := range e.Violations {
+		if v == ruleID {
+			return true
+		}
+	}
+	return false
+}
+
+func NewPasswordPolicy() *PasswordPolicy {
+	p := &PasswordPolicy{
+		MinLength:            8,
+		MaxLength:            64,
+		RejectEmailLocalPart: true,
+		Rules:                make([]*PasswordRule, 0),
+		blocklist:            make(map[string]struct{}),
+	}
+	_ = p.LoadBlocklist(strings.NewReader(commonPasswords))
+	return p
+}
+
+func (p *PasswordPolicy) AddRule(id string, check PasswordRuleFunc) {
+	p.Rules = append(p.Rules, &PasswordRule{ID: id, Check: check})
+}
+func (p *PasswordPolicy) AddBlocklist(passwords ...string) {
+	for _, pw := range passwords {
+		pw = strings.ToLower(normalizePassword(strings.TrimSpace(pw)))
+		if pw != "" {
+			p.blocklist[pw] = struct{}{}
+		}
+	}
+}
+
+// LoadBlocklist adds one password per line from r.
+func (p *PasswordPolicy) LoadBlocklist(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		p.AddBlocklist(scanner.Text())
+	}
+	return scanner.Err()
+}
+func (p *PasswordPolicy) IsBlocklisted(password string) bool {
+	_, ok := p.blocklist[strings.ToLower(normalizePassword(password))]
+	return ok
+}
+
+// Check returns a *PasswordPolicyError listing every failed rule, or nil.
+func (p *PasswordPolicy) Check(password string, email string) error {
+	password = normalizePassword(password)
+	violations := make([]string, 0)
+
+	length := utf8.RuneCountInString(password)
+	if p.MinLength > 0 && length < p.MinLength {
+		violations = append(violations, PASSWORD_RULE_MINLENGTH)
+	}
+	if (p.MaxLength > 0 && length > p.MaxLength) || len(password) > maxPasswordBytes {
+		violations = append(violations, PASSWORD_RULE_MAXLENGTH)
+	}
+
+	if p.RejectEmailLocalPart && containsEmailLocalPart(password, email) {
+		violations = append(violations, PASSWORD_RULE_EMAIL)
+	}
+
+	if p.IsBlocklisted(password) {
+		violations = append(violations, PASSWORD_RULE_BLOCKLIST)
+	}
+
+	if p.Breaches != nil {
+		count, err := p.Breaches.BreachCount(password)
+		if err != nil {
+			return err
+		}
+
+		threshold := p.BreachThreshold
+		if threshold < 1 {
+			threshold = 1
+		}
+		if count >= threshold {
+			violations = append(violations, PASSWORD_RULE_BREACHED)
+		}
+	}
+
+	for _, rule := range p.Rules {
+		if !rule.Check(password, email) {
+			violations = append(violations, rule.ID)
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+
+	return nil
+}
+
+func normalizePassword(pw string) string {
+	return norm.NFKC.String(pw)
+}
+func containsEmailLocalPart(password string, email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+
+	local := strings.ToLower(email[:at])
+	// very short local parts would match almost anything
+	if utf8.RuneCountInString(local) < 3 {
+		return false
+	}
+
+	return strings.Contains(strings.ToLower(password), local)
+}
+func checkPassword(password string, email string) error {
+	policy := getPasswordPolicy()
+	if policy == nil {
+		return nil
+	}
+	return policy.Check(password, email)
+}
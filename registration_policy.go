@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"golang.org/x/net/idna"
+	"io"
+	"strings"
+)
+
+//go:embed disposable_domains.txt
+var disposableDomains string
+
+// RegistrationPolicy restricts which email domains can be used to register
+// or be changed to. A pattern is a domain, matching only itself, or
+// "*.domain", matching every subdomain of it.
+//
+// Denied domains always fail. When Allow is not empty only the domains it
+// matches pass. With BlockDisposable set, addresses at domains on the
+// disposable list, or their subdomains, fail as well.
+type RegistrationPolicy struct {
+	Allow           []string
+	Deny            []string
+	BlockDisposable bool
+
+	disposable map[string]struct{}
+}
+
+func NewRegistrationPolicy() *RegistrationPolicy {
+	p := &RegistrationPolicy{
+		Allow:           make([]string, 0),
+		Deny:            make([]string, 0),
+		BlockDisposable: true,
+		disposable:      make(map[string]struct{}),
+	}
+	_ = p.LoadDisposableDomains(strings.NewReader(disposableDomains))
+	return p
+}
+
+// LoadDisposableDomains adds one domain per line from r to the disposable
+// list, on top of the bundled one. Empty lines and lines starting with #
+// are skipped.
+func (p *RegistrationPolicy) LoadDisposableDomains(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		p.AddDisposableDomains(scanner.Text())
+	}
+	return scanner.Err()
+}
+func (p *RegistrationPolicy) AddDisposableDomains(domains ...string) {
+	for _, domain := range domains {
+		domain = strings.TrimSpace(domain)
+		if domain == "" || strings.HasPrefix(domain, "#") {
+			continue
+		}
+		p.disposable[normalizeDomain(domain)] = struct{}{}
+	}
+}
+func (p *RegistrationPolicy) IsDisposable(domain string) bool {
+	domain = normalizeDomain(domain)
+	for {
+		if _, ok := p.disposable[domain]; ok {
+			return true
+		}
+
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			return false
+		}
+		domain = domain[dot+1:]
+	}
+}
+
+// Check returns ERROR_DOMAINNOTALLOWED or ERROR_DISPOSABLEEMAIL if email may
+// not be registered.
+func (p *RegistrationPolicy) Check(email string) error {
+	key, err := NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	domain := key[strings.LastIndex(key, "@")+1:]
+
+	if matchDomain(p.Deny, domain) {
+		return errors.New(ERROR_DOMAINNOTALLOWED)
+	}
+
+	if len(p.Allow) > 0 && !matchDomain(p.Allow, domain) {
+		return errors.New(ERROR_DOMAINNOTALLOWED)
+	}
+
+	if p.BlockDisposable && p.IsDisposable(domain) {
+		return errors.New(ERROR_DISPOSABLEEMAIL)
+	}
+
+	return nil
+}
+
+func matchDomain(patterns []string, domain string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(domain, "."+normalizeDomain(pattern[2:])) {
+				return true
+			}
+			continue
+		}
+
+		if domain == normalizeDomain(pattern) {
+			return true
+		}
+	}
+	return false
+}
+func normalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.TrimSpace(domain), ".")
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return strings.ToLower(domain)
+	}
+	return strings.ToLower(ascii)
+}
+func checkRegistrationEmail(email string) error {
+	policy := getRegistrationPolicy()
+	if policy == nil {
+		return nil
+	}
+	return policy.Check(email)
+}
@@ -16,6 +16,43 @@ const (
 	ERROR_SETCOOKIE        string = "failed to set remember cookie"
 	ERROR_NODATABASECONN   string = "no database connection"
 	ERROR_INVALIDUSERID    string = "invalid user id"
+	ERROR_EMAILTAKEN       string = "email already in use"
+	ERROR_ALREADYVERIFIED  string = "email is already verified"
+	ERROR_RESENDCOOLDOWN   string = "confirmation was sent recently"
+	ERROR_PASSWORDPOLICY   string = "password does not meet policy"
+	ERROR_BADBREACHINDEX   string = "invalid breach index"
+	ERROR_PASSWORDREUSED   string = "password was used recently"
+	ERROR_PASSWORDTOOYOUNG string = "password was changed too recently"
+	ERROR_PASSWORDCHANGE   string = "password change required"
+	ERROR_INVALIDLOGIN     string = "invalid email or password"
+	ERROR_NOTEMPLATE       string = "email template not found"
+	ERROR_INVALIDCODE      string = "invalid code"
+	ERROR_INVALIDPHONE     string = "invalid phone number"
+	ERROR_PHONETAKEN       string = "phone number already in use"
+	ERROR_PHONENOTVERIFIED string = "phone number is not verified"
+	ERROR_SECONDFACTOR     string = "second factor required"
+	ERROR_INVALIDUSERNAME  string = "invalid username"
+	ERROR_USERNAMETAKEN    string = "username already in use"
+	ERROR_DOMAINNOTALLOWED string = "email domain not allowed"
+	ERROR_DISPOSABLEEMAIL  string = "disposable email not allowed"
+	ERROR_INVITATIONONLY   string = "registration requires an invitation"
+	ERROR_PENDINGREVIEW    string = "account is pending review"
+	ERROR_NOTPENDING       string = "account is not pending review"
+	ERROR_USERSUSPENDED    string = "user suspended"
+	ERROR_INVALIDUNTIL     string = "suspension must end in the future"
+	ERROR_REVIEWNOTSENT    string = "decision saved but not sent"
+	ERROR_STATUSCHANGED    string = "account status changed meanwhile"
+	ERROR_NOTDEADLETTER    string = "email is not dead-lettered"
+	ERROR_INVALIDINTERVAL  string = "interval must be positive"
+	ERROR_INVALIDSTATUS    string = "not allowed in account status"
+)
+
+const (
+	PASSWORD_RULE_MINLENGTH string = "min_length"
+	PASSWORD_RULE_MAXLENGTH string = "max_length"
+	PASSWORD_RULE_EMAIL     string = "contains_email"
+	PASSWORD_RULE_BLOCKLIST string = "blocklisted"
+	PASSWORD_RULE_BREACHED  string = "breached"
 )
 
 const (
@@ -25,6 +62,69 @@ const (
 	ROLE_DEVELOPER  int64 = 256
 )
 
+const (
+	AUDIT_PASSWORD_CHANGED string = "password_changed"
+	AUDIT_ACCOUNT_APPROVED string = "account_approved"
+	AUDIT_ACCOUNT_REJECTED string = "account_rejected"
+	AUDIT_USER_SUSPENDED   string = "user_suspended"
+	AUDIT_USER_BANNED      string = "user_banned"
+	AUDIT_USER_REINSTATED  string = "user_reinstated"
+	AUDIT_DELETION_REQUEST string = "deletion_requested"
+	AUDIT_DELETION_CANCEL  string = "deletion_cancelled"
+)
+
+const (
+	REVIEW_APPROVED string = "approved"
+	REVIEW_REJECTED string = "rejected"
+)
+
+const DEFAULT_LOCALE string = "en"
+
+const (
+	CODE_LOGIN   string = "login"
+	CODE_CONFIRM string = "confirm"
+	CODE_RESET   string = "reset"
+
+	CODE_PHONE_VERIFY   string = "phone_verify"
+	CODE_SECOND_FACTOR  string = "second_factor"
+	CODE_PHONE_RECOVERY string = "phone_recovery"
+)
+
+const (
+	MESSAGE_SMS_CODE string = "sms_code"
+)
+
+const (
+	CONFIRMATION_LINK int64 = 0
+	CONFIRMATION_CODE int64 = 1
+)
+
+const (
+	EMAIL_CONFIRMATION string = "confirmation"
+	EMAIL_RESET        string = "reset"
+	EMAIL_CHANGE       string = "email_change"
+	EMAIL_REVERT       string = "email_revert"
+	EMAIL_NOTICE       string = "notice"
+	EMAIL_LOGIN_LINK   string = "login_link"
+	EMAIL_CODE         string = "code"
+	EMAIL_INVITATION   string = "invitation"
+	EMAIL_REVIEW       string = "review"
+	EMAIL_DELETION     string = "deletion"
+)
+
+const (
+	OUTBOX_PENDING int64 = 0
+	OUTBOX_SENT    int64 = 1
+	OUTBOX_DEAD    int64 = 2
+	OUTBOX_SENDING int64 = 3
+)
+
+const (
+	NOTICE_ACCOUNT_EXISTS    string = "account_exists"
+	NOTICE_RESET_UNAVAILABLE string = "reset_unavailable"
+	NOTICE_LOGIN_UNAVAILABLE string = "login_unavailable"
+)
+
 const (
 	STATUS_NORMAL         int64 = 0
 	STATUS_ARCHIVED       int64 = 1
@@ -34,8 +134,134 @@ const (
 	STATUS_SUSPENDED      int64 = 5
 )
 
+// SelectorTokenCallBack hands a new selector and token to the caller, e.g. to
+// email them as a link. Flows call it after committing, so it may use the
+// database, and undo their changes if it returns an error. The callbacks of
+// an EmailSender whose Mailer is an Outbox are the exception: their email is
+// written in the flow's transaction instead.
 type SelectorTokenCallBack func(selector string, token string) error
 
+var (
+	passwordPolicy        = NewPasswordPolicy()
+	passwordHistoryLength = int64(5)
+	minPasswordAge        = int64(0)
+	passwordExpiry        = int64(0)
+	auditCallBack         AuditCallBack
+	enumerationSafe       = false
+	noticeCallBack        NoticeCallBack
+	catalog               = NewCatalog()
+	confirmationMethod    = CONFIRMATION_LINK
+	codeLength            = int64(6)
+	usernamePolicy        = NewUsernamePolicy()
+	emailNormalizer       = NewEmailNormalizer()
+	registrationPolicy    *RegistrationPolicy
+	invitationOnly        = false
+	moderated             = false
+	reviewCallBack        ReviewCallBack
+	deletionGracePeriod   = int64(30 * 24 * 60 * 60)
+)
+
+// SetPasswordPolicy replaces the policy new passwords are checked against.
+// A nil policy disables the checks.
+func SetPasswordPolicy(p *PasswordPolicy) {
+	passwordPolicy = p
+}
+
+// SetPasswordHistory sets how many previous passwords are remembered per user
+// and how long a password must be kept before ChangePassword replaces it
+// again. Resets are never held back by the minimum age.
+func SetPasswordHistory(length int64, minAge time.Duration) {
+	passwordHistoryLength = length
+	minPasswordAge = int64(minAge / time.Second)
+}
+
+// SetAuditCallBack registers a function that is told about every audit event,
+// for example to forward it to an application log.
+func SetAuditCallBack(cb AuditCallBack) {
+	auditCallBack = cb
+}
+
+// SetEnumerationSafe hides whether an email address is registered. Login
+// returns ERROR_INVALIDLOGIN for unknown users and wrong passwords alike,
+// and registration and reset requests for existing or unusable accounts
+// succeed while notify tells the real owner what happened. notify is called
+// from its own goroutine.
+func SetEnumerationSafe(enabled bool, notify NoticeCallBack) {
+	enumerationSafe = enabled
+	noticeCallBack = notify
+}
+
+// SetConfirmationMethod chooses whether RegisterWithConfirmation sends a
+// link (CONFIRMATION_LINK) or a numeric code (CONFIRMATION_CODE). In code
+// mode its callback gets an empty selector and the code as the token, and
+// the address is confirmed with ConfirmEmailWithCode.
+func SetConfirmationMethod(method int64) {
+	confirmationMethod = method
+}
+
+// SetCodeLength sets the number of digits of one-time codes, 6 to 8.
+func SetCodeLength(length int64) {
+	if length < 6 {
+		length = 6
+	}
+	if length > 8 {
+		length = 8
+	}
+	codeLength = length
+}
+
+// SetUsernamePolicy replaces the policy usernames are checked against.
+func SetUsernamePolicy(p *UsernamePolicy) {
+	usernamePolicy = p
+}
+
+// SetEmailNormalizer replaces the normalizer that decides when two email
+// addresses belong to the same account. Changing it on a populated
+// database requires recomputing users.email_key with MigrateEmailKeys.
+func SetEmailNormalizer(n *EmailNormalizer) {
+	emailNormalizer = n
+}
+
+// SetRegistrationPolicy restricts the email domains accepted by Register,
+// RegisterWithConfirmation and RequestEmailChange. A nil policy, the
+// default, accepts every domain.
+func SetRegistrationPolicy(p *RegistrationPolicy) {
+	registrationPolicy = p
+}
+
+// SetInvitationOnly closes Register and RegisterWithConfirmation, so new
+// accounts can only be created through RegisterWithInvitation.
+func SetInvitationOnly(enabled bool) {
+	invitationOnly = enabled
+}
+
+// SetModeration makes Register and RegisterWithConfirmation create accounts
+// with STATUS_PENDING_REVIEW, which cannot log in until a moderator calls
+// Approve. notify, if set, is told about Approve and Reject. Invited users
+// are not held for review.
+func SetModeration(enabled bool, notify ReviewCallBack) {
+	moderated = enabled
+	reviewCallBack = notify
+}
+
+// SetDeletionGracePeriod sets how long an account deleted with
+// RequestAccountDeletion can be restored before PurgeDeletedAccounts
+// removes it.
+func SetDeletionGracePeriod(d time.Duration) {
+	deletionGracePeriod = int64(d / time.Second)
+}
+
+// SetCatalog replaces the catalog used by LocalizeError and LocalizeMessage.
+func SetCatalog(c *Catalog) {
+	catalog = c
+}
+
+// SetPasswordExpiry makes Login require a password change once a password
+// is older than maxAge. Zero disables expiry.
+func SetPasswordExpiry(maxAge time.Duration) {
+	passwordExpiry = int64(maxAge / time.Second)
+}
+
 func getTable(id string) string {
 	switch id {
 	case "users":
@@ -46,6 +272,30 @@ func getTable(id string) string {
 		return "users_remembered"
 	case "users_resets":
 		return "users_resets"
+	case "users_email_reverts":
+		return "users_email_reverts"
+	case "users_password_history":
+		return "users_password_history"
+	case "users_audit":
+		return "users_audit"
+	case "auth_outbox":
+		return "auth_outbox"
+	case "users_login_links":
+		return "users_login_links"
+	case "users_codes":
+		return "users_codes"
+	case "users_challenges":
+		return "users_challenges"
+	case "users_username_reservations":
+		return "users_username_reservations"
+	case "users_invitations":
+		return "users_invitations"
+	case "users_reviews":
+		return "users_reviews"
+	case "users_status_history":
+		return "users_status_history"
+	case "users_deletions":
+		return "users_deletions"
 	default:
 		panic("invalid table name")
 	}
@@ -53,6 +303,23 @@ func getTable(id string) string {
 func getUserConfirmationExpiry() int64 {
 	return time.Now().Add(time.Duration(time.Hour)).Unix()
 }
+func getUserEmailRevertExpiry() int64 {
+	// 168 Hours = 7 days
+	return time.Now().Add(time.Duration(time.Hour * 168)).Unix()
+}
+func getUserLoginLinkExpiry() int64 {
+	return time.Now().Add(time.Duration(time.Minute * 15)).Unix()
+}
+func getUserCodeExpiry() int64 {
+	return time.Now().Add(time.Duration(time.Minute * 10)).Unix()
+}
+func getUserChallengeExpiry() int64 {
+	return time.Now().Add(time.Duration(time.Minute * 10)).Unix()
+}
+func getUserInvitationExpiry() int64 {
+	// 168 Hours = 7 days
+	return time.Now().Add(time.Duration(time.Hour * 168)).Unix()
+}
 func getUserRememberedExpiry() int64 {
 	// 672 Hours = 28 days
 	return time.Now().Add(time.Duration(time.Hour * 672)).Unix()
@@ -63,3 +330,81 @@ func getUserResetExpiry() int64 {
 func getMaxUserResetRequests() int64 {
 	return 2
 }
+func getConfirmationResendCooldown() int64 {
+	// seconds between two confirmation emails
+	return 300
+}
+func getMaxConfirmationResends() int64 {
+	return 3
+}
+func getConfirmationResendWindow() int64 {
+	// seconds without a confirmation email after which the count starts over
+	return 86400
+}
+func getPasswordPolicy() *PasswordPolicy {
+	return passwordPolicy
+}
+func getPasswordHistoryLength() int64 {
+	return passwordHistoryLength
+}
+func getMinPasswordAge() int64 {
+	// seconds
+	return minPasswordAge
+}
+func getPasswordExpiry() int64 {
+	// seconds
+	return passwordExpiry
+}
+func getAuditCallBack() AuditCallBack {
+	return auditCallBack
+}
+func isEnumerationSafe() bool {
+	return enumerationSafe
+}
+func getNoticeCallBack() NoticeCallBack {
+	return noticeCallBack
+}
+func getCatalog() *Catalog {
+	return catalog
+}
+func getUsernamePolicy() *UsernamePolicy {
+	return usernamePolicy
+}
+func getEmailNormalizer() *EmailNormalizer {
+	return emailNormalizer
+}
+func getRegistrationPolicy() *RegistrationPolicy {
+	return registrationPolicy
+}
+func isInvitationOnly() bool {
+	return invitationOnly
+}
+func isModerated() bool {
+	return moderated
+}
+func getReviewCallBack() ReviewCallBack {
+	return reviewCallBack
+}
+func getDeletionPurgeTime() int64 {
+	return time.Now().Unix() + deletionGracePeriod
+}
+func getConfirmationMethod() int64 {
+	return confirmationMethod
+}
+func getCodeLength() int64 {
+	return codeLength
+}
+func getMaxCodeAttempts() int64 {
+	return 5
+}
+func getMaxCodeIssues() int64 {
+	return 5
+}
+func getCodeCooldown() int64 {
+	// seconds between two codes for the same purpose
+	return 60
+}
+func getCodeWindow() int64 {
+	// seconds after the first code during which attempts and codes add up
+	return 3600
+}
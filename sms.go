@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SMSSender delivers text messages to E.164 phone numbers, for example
+// through an SMS gateway's HTTP API.
+type SMSSender interface {
+	Send(to string, message string) error
+}
+
+type SMSMessage struct {
+	To      string
+	Message string
+}
+
+// FakeSMSSender keeps messages in memory instead of sending them, for
+// development and tests.
+type FakeSMSSender struct {
+	mu       sync.Mutex
+	messages []SMSMessage
+}
+
+func NewFakeSMSSender() *FakeSMSSender {
+	return &FakeSMSSender{}
+}
+
+func (s *FakeSMSSender) Send(to string, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, SMSMessage{To: to, Message: message})
+	return nil
+}
+func (s *FakeSMSSender) Messages() []SMSMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SMSMessage(nil), s.messages...)
+}
+
+// sendSMSCode sends code to phone in the user's locale.
+func sendSMSCode(sms SMSSender, phone string, locale string, code string) error {
+	return sms.Send(phone, fmt.Sprintf(LocalizeMessage(locale, MESSAGE_SMS_CODE), code))
+}
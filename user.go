@@ -5,26 +5,47 @@ import (
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	"github.com/stockholmr/database"
+	"time"
 )
 
 type User struct {
 	ID          *sql.NullInt64  `db:"id"`
 	Email       *sql.NullString `db:"email"`
+	EmailKey    *sql.NullString `db:"email_key"`
 	Password    *sql.NullString `db:"password"`
 	Status      *sql.NullInt64  `db:"status"`
+	StatusUntil *sql.NullInt64  `db:"status_until"`
 	Verified    *sql.NullInt64  `db:"verified"`
 	Resettable  *sql.NullInt64  `db:"resettable"`
 	Roles       *sql.NullInt64  `db:"roles_mask"`
 	Registered  *sql.NullInt64  `db:"registered"`
 	LastLogin   *sql.NullInt64  `db:"last_login"`
 	ForceLogout *sql.NullInt64  `db:"force_logout"`
+
+	PasswordChanged     *sql.NullInt64  `db:"password_changed_at"`
+	ForcePasswordChange *sql.NullInt64  `db:"must_change_password"`
+	Locale              *sql.NullString `db:"locale"`
+	Phone               *sql.NullString `db:"phone"`
+	PhoneVerified       *sql.NullInt64  `db:"phone_verified"`
+	PhoneTwoFactor      *sql.NullInt64  `db:"phone_two_factor"`
+	Username            *sql.NullString `db:"username"`
+	UsernameKey         *sql.NullString `db:"username_key"`
+
+	// kept on the user so purging expired confirmations keeps the limit
+	ConfirmationSent    *sql.NullInt64 `db:"confirmation_sent"`
+	ConfirmationResends *sql.NullInt64 `db:"confirmation_resends"`
 }
 
 func NewUser(email string, password string, registered int64) *User {
 	return &User{
 		Email:      newNullString(email),
+		EmailKey:   newNullString(emailKey(email)),
 		Password:   newNullString(password),
+		Status:     newNullInt64(STATUS_NORMAL),
+		Verified:   newNullInt64(0),
 		Registered: newNullInt64(registered),
+
+		PasswordChanged: newNullInt64(registered),
 	}
 }
 
@@ -43,12 +64,50 @@ func (u *User) IsRegistered() bool {
 	return u.Registered.Valid && u.Registered.Int64 == 1
 }
 
+// IsSuspensionOver reports whether a suspension has passed its end.
+func (u *User) IsSuspensionOver() bool {
+	return u.Status.Int64 == STATUS_SUSPENDED && u.StatusUntil.Valid && u.StatusUntil.Int64 > 0 && time.Now().Unix() >= u.StatusUntil.Int64
+}
+func (u *User) IsPhoneVerified() bool {
+	return u.PhoneVerified.Valid && u.PhoneVerified.Int64 == 1 && u.Phone.Valid
+}
+func (u *User) IsPhoneTwoFactorEnabled() bool {
+	return u.PhoneTwoFactor.Valid && u.PhoneTwoFactor.Int64 == 1 && u.IsPhoneVerified()
+}
+func (u *User) IsPasswordChangeRequired() bool {
+	return u.ForcePasswordChange.Valid && u.ForcePasswordChange.Int64 == 1
+}
+
+// HasPasswordExpired reports whether the password is older than maxAge
+// seconds. A maxAge of zero or less never expires.
+func (u *User) HasPasswordExpired(maxAge int64) bool {
+	if maxAge <= 0 || !u.PasswordChanged.Valid {
+		return false
+	}
+	return time.Now().Unix()-u.PasswordChanged.Int64 > maxAge
+}
+
 func (u *User) GetID() int64 {
 	return u.ID.Int64
 }
+func (u *User) GetUsername() string {
+	if u.Username == nil || !u.Username.Valid {
+		return ""
+	}
+	return u.Username.String
+}
+
+// GetLocale returns the stored locale, or DEFAULT_LOCALE if none is set.
+func (u *User) GetLocale() string {
+	if u.Locale == nil || !u.Locale.Valid || u.Locale.String == "" {
+		return DEFAULT_LOCALE
+	}
+	return u.Locale.String
+}
 
 func (u *User) SetEmail(v string) {
 	u.Email = &sql.NullString{String: v, Valid: true}
+	u.EmailKey = &sql.NullString{String: emailKey(v), Valid: true}
 }
 func (u *User) SetPassword(v string) {
 	u.Password = &sql.NullString{String: v, Valid: true}
@@ -79,6 +138,16 @@ func (u *User) SetResettable(v bool) {
 	}
 	u.Resettable = &sql.NullInt64{Int64: 0, Valid: true}
 }
+func (u *User) SetPasswordChanged(v int64) {
+	u.PasswordChanged = &sql.NullInt64{Int64: v, Valid: true}
+}
+func (u *User) SetForcePasswordChange(v bool) {
+	if v {
+		u.ForcePasswordChange = &sql.NullInt64{Int64: 1, Valid: true}
+		return
+	}
+	u.ForcePasswordChange = &sql.NullInt64{Int64: 0, Valid: true}
+}
 func (u *User) SetForceLogout(v bool) {
 	if v {
 		u.ForceLogout = &sql.NullInt64{Int64: 1, Valid: true}
@@ -93,8 +162,10 @@ func dbCreateUser(db *sqlx.DB, user *User) (int64, error) {
 		getTable("users"),
 		database.NewFieldValuePairCollection(
 			database.NewFieldValuePair("email", user.Email),
+			database.NewFieldValuePair("email_key", user.EmailKey),
 			database.NewFieldValuePair("password", user.Password),
 			database.NewFieldValuePair("registered", user.Registered),
+			database.NewFieldValuePair("password_changed_at", user.PasswordChanged),
 		),
 	)
 	if err != nil {
@@ -102,6 +173,20 @@ func dbCreateUser(db *sqlx.DB, user *User) (int64, error) {
 	}
 	return id.Int64, err
 }
+func dbTxCreateUser(tx *sqlx.Tx, user *User) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users"),
+		[]string{"email", "email_key", "password", "status", "verified", "registered", "password_changed_at"},
+		user.Email,
+		user.EmailKey,
+		user.Password,
+		user.Status,
+		user.Verified,
+		user.Registered,
+		user.PasswordChanged,
+	)
+}
 func dbDeleteUser(db *sqlx.DB, user *User) error {
 	err := database.Update(
 		db,
@@ -115,22 +200,261 @@ func dbDeleteUser(db *sqlx.DB, user *User) error {
 	return err
 }
 func dbHardDeleteUser(db *sqlx.DB, user *User) error {
-	err := database.Delete(
-		db,
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = txPurgeUser(tx, user.GetID())
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+func dbGetUserByEmail(db *sqlx.DB, email string) (*User, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE email_key=? AND status=?", getTable("users"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(emailKey(email), STATUS_NORMAL)
+
+	str := new(User)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+func dbGetUserByEmailAndStatus(db *sqlx.DB, email string, status int64) (*User, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE email_key=? AND status=?", getTable("users"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(emailKey(email), status)
+
+	str := new(User)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+func dbGetUserByIDAndStatus(db *sqlx.DB, id int64, status int64) (*User, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE id=? AND status=?", getTable("users"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(id, status)
+
+	str := new(User)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+
+// dbGetUserByEmailNotArchived finds accounts in any state but deleted.
+func dbGetUserByEmailNotArchived(db *sqlx.DB, email string) (*User, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE email_key=? AND status<>?", getTable("users"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(emailKey(email), STATUS_ARCHIVED)
+
+	str := new(User)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+func dbGetUserByIDNotArchived(db *sqlx.DB, id int64) (*User, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE id=? AND status<>?", getTable("users"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(id, STATUS_ARCHIVED)
+
+	str := new(User)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+func dbGetUserByIDAnyStatus(db *sqlx.DB, id int64) (*User, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE id=?", getTable("users"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(id)
+
+	str := new(User)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+func dbGetUsersSuspensionOver(db *sqlx.DB, now int64) ([]*User, error) {
+	cmd := fmt.Sprintf(
+		"SELECT * FROM `%s` WHERE status=? AND status_until>0 AND status_until<=? ORDER BY id",
 		getTable("users"),
-		database.NewFieldValuePair("id", user.ID),
 	)
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Queryx(STATUS_SUSPENDED, now)
+	if err != nil {
+		return nil, err
+	}
+
+	strArr := make([]*User, 0)
+	for rows.Next() {
+		str := new(User)
+		err = rows.StructScan(str)
+		if err != nil {
+			return nil, err
+		}
+		strArr = append(strArr, str)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return strArr, nil
+}
+func dbGetUsersByStatus(db *sqlx.DB, status int64) ([]*User, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE status=? ORDER BY id", getTable("users"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Queryx(status)
+	if err != nil {
+		return nil, err
+	}
+
+	strArr := make([]*User, 0)
+	for rows.Next() {
+		str := new(User)
+		err = rows.StructScan(str)
+		if err != nil {
+			return nil, err
+		}
+		strArr = append(strArr, str)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return strArr, nil
+}
+func dbTxUpdateUserStatus(tx *sqlx.Tx, userID int64, status int64) error {
+	cmd := fmt.Sprintf("UPDATE `%s` SET status=? WHERE id=?", getTable("users"))
+	_, err := tx.Exec(cmd, status, userID)
 	return err
 }
-func dbGetUserByEmail(db *sqlx.DB, email string) (*User, error) {
-	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE email=? AND status=?", getTable("users"))
+
+// dbTxReleaseUserEmail replaces the user's address with a placeholder that
+// no address normalizes to, so the address can register again.
+func dbTxReleaseUserEmail(tx *sqlx.Tx, userID int64) error {
+	placeholder := fmt.Sprintf("#%d", userID)
+	cmd := fmt.Sprintf("UPDATE `%s` SET email=?, email_key=? WHERE id=?", getTable("users"))
+	_, err := tx.Exec(cmd, placeholder, placeholder, userID)
+	return err
+}
+func dbGetUserByUsername(db *sqlx.DB, username string) (*User, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE username_key=? AND status=?", getTable("users"))
 
 	stmt, err := db.Preparex(cmd)
 	if err != nil {
 		return nil, err
 	}
 
-	result := stmt.QueryRowx(email, STATUS_NORMAL)
+	result := stmt.QueryRowx(usernameKey(username), STATUS_NORMAL)
 
 	str := new(User)
 	err = result.StructScan(str)
@@ -146,6 +470,35 @@ func dbGetUserByEmail(db *sqlx.DB, email string) (*User, error) {
 
 	return str, nil
 }
+func dbGetUserCountByUsername(db *sqlx.DB, username string) (int64, error) {
+	cmd := fmt.Sprintf("SELECT COUNT(*) as COUNT FROM `%s` WHERE username_key=?", getTable("users"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return -999, err
+	}
+	result := stmt.QueryRowx(usernameKey(username))
+	str := make(map[string]interface{}, 0)
+	err = result.MapScan(str)
+
+	if err != nil {
+		return -999, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return -999, err
+	}
+
+	count := str["COUNT"].(int64)
+
+	return count, nil
+}
+func dbTxUpdateUserUsername(tx *sqlx.Tx, userID int64, username string) error {
+	cmd := fmt.Sprintf("UPDATE `%s` SET username=?, username_key=? WHERE id=?", getTable("users"))
+	_, err := tx.Exec(cmd, username, usernameKey(username), userID)
+	return err
+}
 func dbGetUserByID(db *sqlx.DB, id int64) (*User, error) {
 	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE id=? AND status=?", getTable("users"))
 
@@ -170,6 +523,30 @@ func dbGetUserByID(db *sqlx.DB, id int64) (*User, error) {
 
 	return str, nil
 }
+func dbGetUserCountByEmail(db *sqlx.DB, email string) (int64, error) {
+	cmd := fmt.Sprintf("SELECT COUNT(*) as COUNT FROM `%s` WHERE email_key=?", getTable("users"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return -999, err
+	}
+	result := stmt.QueryRowx(emailKey(email))
+	str := make(map[string]interface{}, 0)
+	err = result.MapScan(str)
+
+	if err != nil {
+		return -999, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return -999, err
+	}
+
+	count := str["COUNT"].(int64)
+
+	return count, nil
+}
 func dbUpdateUser(db *sqlx.DB, userID int64, fields []*database.FieldValuePair) error {
 	err := database.Update(
 		db,
@@ -186,6 +563,7 @@ func dbUpdateUserEmail(db *sqlx.DB, user *User) error {
 		getTable("users"),
 		database.NewFieldValuePairCollection(
 			database.NewFieldValuePair("email", user.Email),
+			database.NewFieldValuePair("email_key", user.EmailKey),
 		),
 		database.NewFieldValuePair("id", user.ID),
 	)
@@ -279,3 +657,94 @@ func dbUpdateUserForceLogout(db *sqlx.DB, user *User) error {
 	)
 	return err
 }
+func dbTxUpdateUserEmailVerified(tx *sqlx.Tx, userID int64, email string) error {
+	cmd := fmt.Sprintf("UPDATE `%s` SET email=?, email_key=?, verified=? WHERE id=?", getTable("users"))
+	_, err := tx.Exec(cmd, email, emailKey(email), 1, userID)
+	return err
+}
+func dbTxIncrementUserForceLogout(tx *sqlx.Tx, userID int64) error {
+	cmd := fmt.Sprintf("UPDATE `%s` SET force_logout=force_logout+1 WHERE id=?", getTable("users"))
+	_, err := tx.Exec(cmd, userID)
+	return err
+}
+func dbTxUpdateUserPassword(tx *sqlx.Tx, userID int64, password string, mustChange bool) error {
+	force := 0
+	if mustChange {
+		force = 1
+	}
+
+	cmd := fmt.Sprintf(
+		"UPDATE `%s` SET password=?, password_changed_at=?, must_change_password=? WHERE id=?",
+		getTable("users"),
+	)
+	_, err := tx.Exec(cmd, password, time.Now().Unix(), force, userID)
+	return err
+}
+func dbTxUpdateUserPhoneVerified(tx *sqlx.Tx, userID int64, phone string) error {
+	cmd := fmt.Sprintf("UPDATE `%s` SET phone=?, phone_verified=? WHERE id=?", getTable("users"))
+	_, err := tx.Exec(cmd, phone, 1, userID)
+	return err
+}
+func dbGetUserCountByPhone(db *sqlx.DB, phone string) (int64, error) {
+	cmd := fmt.Sprintf("SELECT COUNT(*) as COUNT FROM `%s` WHERE phone=? AND phone_verified=?", getTable("users"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return -999, err
+	}
+	result := stmt.QueryRowx(phone, 1)
+	str := make(map[string]interface{}, 0)
+	err = result.MapScan(str)
+
+	if err != nil {
+		return -999, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return -999, err
+	}
+
+	count := str["COUNT"].(int64)
+
+	return count, nil
+}
+func dbTxUpdateUserConfirmationSent(tx *sqlx.Tx, userID int64, resends int64) error {
+	cmd := fmt.Sprintf("UPDATE `%s` SET confirmation_sent=?, confirmation_resends=? WHERE id=?", getTable("users"))
+	_, err := tx.Exec(cmd, time.Now().Unix(), resends, userID)
+	return err
+}
+func dbGetUserByPhone(db *sqlx.DB, phone string) (*User, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE phone=? AND phone_verified=? AND status=?", getTable("users"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(phone, 1, STATUS_NORMAL)
+
+	str := new(User)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+func dbTxUpdateUserRoles(tx *sqlx.Tx, userID int64, roles int64) error {
+	cmd := fmt.Sprintf("UPDATE `%s` SET roles_mask=? WHERE id=?", getTable("users"))
+	_, err := tx.Exec(cmd, roles, userID)
+	return err
+}
+func dbTxUpdateUserVerified(tx *sqlx.Tx, userID int64) error {
+	cmd := fmt.Sprintf("UPDATE `%s` SET verified=? WHERE id=?", getTable("users"))
+	_, err := tx.Exec(cmd, 1, userID)
+	return err
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+type UserAuditEvent struct {
+	ID      *sql.NullInt64  `db:"id"`
+	UserID  *sql.NullInt64  `db:"user_id"`
+	Event   *sql.NullString `db:"event"`
+	Created *sql.NullInt64  `db:"created"`
+}
+
+// AuditCallBack is called after an audit event has been stored.
+type AuditCallBack func(userID int64, event string)
+
+func NewUserAuditEvent(userID int64, event string, created int64) *UserAuditEvent {
+	return &UserAuditEvent{
+		UserID:  newNullInt64(userID),
+		Event:   newNullString(event),
+		Created: newNullInt64(created),
+	}
+}
+
+// txEmitAuditEvent stores the event inside tx. The caller must call
+// notifyAuditEvent once tx has been committed.
+func txEmitAuditEvent(tx *sqlx.Tx, userID int64, event string) error {
+	_, err := dbTxCreateUserAuditEvent(tx, NewUserAuditEvent(userID, event, time.Now().Unix()))
+	return err
+}
+func notifyAuditEvent(userID int64, event string) {
+	if cb := getAuditCallBack(); cb != nil {
+		cb(userID, event)
+	}
+}
+
+func dbTxCreateUserAuditEvent(tx *sqlx.Tx, e *UserAuditEvent) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users_audit"),
+		[]string{"user_id", "event", "created"},
+		e.UserID,
+		e.Event,
+		e.Created,
+	)
+}
+func dbGetUserAuditEventsByUserID(db *sqlx.DB, userID int64) ([]*UserAuditEvent, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE user_id=? ORDER BY id", getTable("users_audit"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Queryx(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	strArr := make([]*UserAuditEvent, 0)
+	for rows.Next() {
+		str := new(UserAuditEvent)
+		err = rows.StructScan(str)
+		if err != nil {
+			return nil, err
+		}
+		strArr = append(strArr, str)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return strArr, nil
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/stockholmr/database"
+	"time"
+)
+
+// SecondFactorError is returned by Login for users with a second factor.
+// Its selector and token prove the password step to RequestSecondFactor
+// and VerifySecondFactor.
+type SecondFactorError struct {
+	Selector string
+	Token    string
+}
+
+func (e *SecondFactorError) Error() string {
+	return ERROR_SECONDFACTOR
+}
+
+// UserChallenge is a password step waiting for its second factor.
+type UserChallenge struct {
+	ID       *sql.NullInt64  `db:"id"`
+	UserID   *sql.NullInt64  `db:"user_id"`
+	Selector *sql.NullString `db:"selector"`
+	Token    *sql.NullString `db:"token"`
+	Expires  *sql.NullInt64  `db:"expires"`
+
+	_token string
+}
+
+func NewUserChallenge(userID int64, expires int64) *UserChallenge {
+	selector, token, hash := createTokenAuthenticator()
+	return &UserChallenge{
+		UserID:   newNullInt64(userID),
+		Selector: newNullString(selector),
+		Token:    newNullString(hash),
+		Expires:  newNullInt64(expires),
+		_token:   token,
+	}
+}
+
+func (c *UserChallenge) GetToken() string {
+	return c._token
+}
+func (c *UserChallenge) GetSelector() string {
+	return c.Selector.String
+}
+func (c *UserChallenge) HasExpired() bool {
+	return time.Now().Unix() > c.Expires.Int64
+}
+
+func dbCreateUserChallenge(db *sqlx.DB, c *UserChallenge) (int64, error) {
+	id, err := database.Insert(
+		db,
+		getTable("users_challenges"),
+		database.NewFieldValuePairCollection(
+			database.NewFieldValuePair("user_id", c.UserID),
+			database.NewFieldValuePair("selector", c.Selector),
+			database.NewFieldValuePair("token", c.Token),
+			database.NewFieldValuePair("expires", c.Expires),
+		),
+	)
+	if err != nil {
+		return -999, err
+	}
+
+	return id.Int64, nil
+}
+
+// dbTxDeleteUserChallenge returns how many rows were deleted, so concurrent
+// verifications of the same challenge can tell which one completed it.
+func dbTxDeleteUserChallenge(tx *sqlx.Tx, selector string) (int64, error) {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE selector=?", getTable("users_challenges"))
+	result, err := tx.Exec(cmd, selector)
+	if err != nil {
+		return -999, err
+	}
+	return result.RowsAffected()
+}
+func dbGetUserChallengeBySelector(db *sqlx.DB, selector string) (*UserChallenge, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE selector=?", getTable("users_challenges"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(selector)
+
+	str := new(UserChallenge)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"math/big"
+	"time"
+)
+
+// CodeCallBack delivers a one-time code, for example by email.
+type CodeCallBack func(code string) error
+
+// UserCode is a short numeric one-time code, the alternative to the
+// selector/token links for clients where links are awkward. Only its hash
+// is stored, and it stops working after getMaxCodeAttempts wrong guesses.
+//
+// A user has one row per purpose, which a new code replaces. The row keeps
+// counting wrong guesses and issued codes until WindowEnds.
+type UserCode struct {
+	ID         *sql.NullInt64  `db:"id"`
+	UserID     *sql.NullInt64  `db:"user_id"`
+	Purpose    *sql.NullString `db:"purpose"`
+	Recipient  *sql.NullString `db:"recipient"`
+	Code       *sql.NullString `db:"code"`
+	Attempts   *sql.NullInt64  `db:"attempts"`
+	Expires    *sql.NullInt64  `db:"expires"`
+	Issues     *sql.NullInt64  `db:"issues"`
+	Sent       *sql.NullInt64  `db:"sent"`
+	WindowEnds *sql.NullInt64  `db:"window_ends"`
+
+	_code string
+}
+
+// NewUserCode creates a code sent to recipient, an email address or phone
+// number.
+func NewUserCode(userID int64, purpose string, recipient string, expires int64) *UserCode {
+	code := randomDigits(getCodeLength())
+	// at most 8 digits, always within bcrypt's limit
+	hash, _ := hashPassword(code)
+	now := time.Now().Unix()
+	return &UserCode{
+		UserID:     newNullInt64(userID),
+		Purpose:    newNullString(purpose),
+		Recipient:  newNullString(recipient),
+		Code:       newNullString(hash),
+		Attempts:   newNullInt64(0),
+		Expires:    newNullInt64(expires),
+		Issues:     newNullInt64(1),
+		Sent:       newNullInt64(now),
+		WindowEnds: newNullInt64(now + getCodeWindow()),
+		_code:      code,
+	}
+}
+
+func (c *UserCode) GetID() int64 {
+	return c.ID.Int64
+}
+func (c *UserCode) GetCode() string {
+	return c._code
+}
+func (c *UserCode) HasExpired() bool {
+	return time.Now().Unix() > c.Expires.Int64
+}
+func (c *UserCode) IsWindowOver() bool {
+	return time.Now().Unix() > c.WindowEnds.Int64
+}
+func (c *UserCode) IsLocked() bool {
+	return c.Attempts.Int64 >= getMaxCodeAttempts()
+}
+
+func randomDigits(length int64) string {
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			panic(err)
+		}
+		b[i] = byte('0' + n.Int64())
+	}
+	return string(b)
+}
+
+// txIssueCode replaces the user's code for purpose with a new one. Within
+// the window of the first code the new one inherits the wrong guesses, so
+// asking for another code gives no extra guesses, and codes are limited to
+// getMaxCodeIssues, one per getCodeCooldown, and none once the guesses are
+// used up. A code that could not be delivered is not deleted for the same
+// reason.
+func txIssueCode(tx *sqlx.Tx, userID int64, purpose string, recipient string) (*UserCode, error) {
+	code := NewUserCode(userID, purpose, recipient, getUserCodeExpiry())
+
+	prev, err := dbTxGetUserCodeByUserID(tx, userID, purpose)
+	if err != nil && err.Error() != "sql: no rows in result set" {
+		return nil, err
+	}
+
+	if prev == nil || prev.IsWindowOver() {
+		err = dbTxDeleteUserCodeByUserID(tx, userID, purpose)
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := dbTxCreateUserCode(tx, code)
+		if err != nil {
+			return nil, err
+		}
+		code.ID = newNullInt64(id)
+
+		return code, nil
+	}
+
+	if prev.IsLocked() ||
+		prev.Issues.Int64 >= getMaxCodeIssues() ||
+		time.Now().Unix()-prev.Sent.Int64 < getCodeCooldown() {
+		return nil, errors.New(ERROR_TOOMANYREQUESTS)
+	}
+
+	code.ID = prev.ID
+	code.Attempts = prev.Attempts
+	code.Issues = newNullInt64(prev.Issues.Int64 + 1)
+	code.WindowEnds = prev.WindowEnds
+
+	err = dbTxUpdateUserCode(tx, code)
+	if err != nil {
+		return nil, err
+	}
+
+	return code, nil
+}
+
+// checkCode returns the user's code for purpose if it matches. Wrong guesses
+// are counted and once they reach the limit the purpose is locked until the
+// window ends.
+func checkCode(db *sqlx.DB, userID int64, purpose string, code string) (*UserCode, error) {
+	c, err := dbGetUserCodeByUserID(db, userID, purpose)
+	if err != nil {
+		if err.Error() == "sql: no rows in result set" {
+			return nil, errors.New(ERROR_INVALIDCODE)
+		}
+		return nil, err
+	}
+
+	if c.IsLocked() {
+		return nil, errors.New(ERROR_TOOMANYREQUESTS)
+	}
+
+	if c.HasExpired() {
+		return nil, errors.New(ERROR_TOKENEXPIRED)
+	}
+
+	if !verifyHash(c.Code.String, code) {
+		attempts, err := dbIncrementUserCodeAttempts(db, c.GetID())
+		if err != nil {
+			return nil, err
+		}
+
+		if attempts >= getMaxCodeAttempts() {
+			return nil, errors.New(ERROR_TOOMANYREQUESTS)
+		}
+
+		return nil, errors.New(ERROR_INVALIDCODE)
+	}
+
+	return c, nil
+}
+
+// txConsumeCode deletes c, failing if another request consumed it first.
+func txConsumeCode(tx *sqlx.Tx, c *UserCode) error {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE id=?", getTable("users_codes"))
+	result, err := tx.Exec(cmd, c.GetID())
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if deleted != 1 {
+		return errors.New(ERROR_INVALIDCODE)
+	}
+
+	return nil
+}
+
+func dbTxCreateUserCode(tx *sqlx.Tx, c *UserCode) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users_codes"),
+		[]string{"user_id", "purpose", "recipient", "code", "attempts", "expires", "issues", "sent", "window_ends"},
+		c.UserID,
+		c.Purpose,
+		c.Recipient,
+		c.Code,
+		c.Attempts,
+		c.Expires,
+		c.Issues,
+		c.Sent,
+		c.WindowEnds,
+	)
+}
+func dbTxUpdateUserCode(tx *sqlx.Tx, c *UserCode) error {
+	cmd := fmt.Sprintf(
+		"UPDATE `%s` SET recipient=?, code=?, expires=?, issues=?, sent=? WHERE id=?",
+		getTable("users_codes"),
+	)
+	_, err := tx.Exec(cmd, c.Recipient, c.Code, c.Expires, c.Issues, c.Sent, c.GetID())
+	return err
+}
+func dbTxDeleteUserCodeByUserID(tx *sqlx.Tx, userID int64, purpose string) error {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE user_id=? AND purpose=?", getTable("users_codes"))
+	_, err := tx.Exec(cmd, userID, purpose)
+	return err
+}
+func dbIncrementUserCodeAttempts(db *sqlx.DB, id int64) (int64, error) {
+	cmd := fmt.Sprintf("UPDATE `%s` SET attempts=attempts+1 WHERE id=?", getTable("users_codes"))
+	_, err := db.Exec(cmd, id)
+	if err != nil {
+		return -999, err
+	}
+
+	var attempts int64
+	cmd = fmt.Sprintf("SELECT attempts FROM `%s` WHERE id=?", getTable("users_codes"))
+	err = db.Get(&attempts, cmd, id)
+	if err != nil {
+		return -999, err
+	}
+
+	return attempts, nil
+}
+func dbGetUserCodeByUserID(db *sqlx.DB, userID int64, purpose string) (*UserCode, error) {
+	cmd := fmt.Sprintf(
+		"SELECT * FROM `%s` WHERE user_id=? AND purpose=? ORDER BY id DESC LIMIT 1",
+		getTable("users_codes"),
+	)
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(userID, purpose)
+
+	str := new(UserCode)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+func dbTxGetUserCodeByUserID(tx *sqlx.Tx, userID int64, purpose string) (*UserCode, error) {
+	cmd := fmt.Sprintf(
+		"SELECT * FROM `%s` WHERE user_id=? AND purpose=? ORDER BY id DESC LIMIT 1",
+		getTable("users_codes"),
+	)
+
+	str := new(UserCode)
+	err := tx.QueryRowx(cmd, userID, purpose).StructScan(str)
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
@@ -15,6 +15,7 @@ type UserConfirmation struct {
 	Selector *sql.NullString `db:"selector"`
 	Token    *sql.NullString `db:"token"`
 	Expires  *sql.NullInt64  `db:"expires"`
+	Created  *sql.NullInt64  `db:"created"`
 	_token   string
 }
 
@@ -26,6 +27,7 @@ func NewUserConfirmation(userID int64, email string, expires int64) *UserConfirm
 		Selector: newNullString(selector),
 		Token:    newNullString(hash),
 		Expires:  newNullInt64(expires),
+		Created:  newNullInt64(time.Now().Unix()),
 		_token:   token,
 	}
 }
@@ -50,6 +52,7 @@ func dbCreateUserConfirmation(db *sqlx.DB, r *UserConfirmation) (int64, error) {
 			database.NewFieldValuePair("selector", r.Selector),
 			database.NewFieldValuePair("token", r.Token),
 			database.NewFieldValuePair("expires", r.Expires),
+			database.NewFieldValuePair("created", r.Created),
 		),
 	)
 	if err != nil {
@@ -58,6 +61,19 @@ func dbCreateUserConfirmation(db *sqlx.DB, r *UserConfirmation) (int64, error) {
 
 	return id.Int64, nil
 }
+func dbTxCreateUserConfirmation(tx *sqlx.Tx, r *UserConfirmation) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users_confirmations"),
+		[]string{"email", "user_id", "selector", "token", "expires", "created"},
+		r.Email,
+		r.UserID,
+		r.Selector,
+		r.Token,
+		r.Expires,
+		r.Created,
+	)
+}
 func dbDeleteUserConfirmation(db *sqlx.DB, selector string) error {
 	err := database.Delete(
 		db,
@@ -74,6 +90,16 @@ func dbDeleteUserConfirmationAllByUserID(db *sqlx.DB, userID int64) error {
 	)
 	return err
 }
+func dbTxDeleteUserConfirmation(tx *sqlx.Tx, selector string) error {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE selector=?", getTable("users_confirmations"))
+	_, err := tx.Exec(cmd, selector)
+	return err
+}
+func dbTxDeleteUserConfirmationAllByUserID(tx *sqlx.Tx, userID int64) error {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE user_id=?", getTable("users_confirmations"))
+	_, err := tx.Exec(cmd, userID)
+	return err
+}
 func dbGetUserConfirmationBySelector(db *sqlx.DB, selector string) (*UserConfirmation, error) {
 	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE selector=?", getTable("users_confirmations"))
 
@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// UserDeletion schedules the purge of an account archived by
+// RequestAccountDeletion. Its selector and token make up the link that
+// cancels the deletion until Purge.
+type UserDeletion struct {
+	ID       *sql.NullInt64  `db:"id"`
+	UserID   *sql.NullInt64  `db:"user_id"`
+	Selector *sql.NullString `db:"selector"`
+	Token    *sql.NullString `db:"token"`
+	Purge    *sql.NullInt64  `db:"purge"`
+	Created  *sql.NullInt64  `db:"created"`
+
+	_token string
+}
+
+func NewUserDeletion(userID int64, purge int64) *UserDeletion {
+	selector, token, hash := createTokenAuthenticator()
+	return &UserDeletion{
+		UserID:   newNullInt64(userID),
+		Selector: newNullString(selector),
+		Token:    newNullString(hash),
+		Purge:    newNullInt64(purge),
+		Created:  newNullInt64(time.Now().Unix()),
+		_token:   token,
+	}
+}
+
+func (d *UserDeletion) GetToken() string {
+	return d._token
+}
+func (d *UserDeletion) GetSelector() string {
+	return d.Selector.String
+}
+func (d *UserDeletion) IsDue() bool {
+	return time.Now().Unix() >= d.Purge.Int64
+}
+
+// userTables lists every table with a user_id column, which a purge
+// empties of the user's rows.
+var userTables = []string{
+	"users_confirmations",
+	"users_remembered",
+	"users_resets",
+	"users_email_reverts",
+	"users_password_history",
+	"users_audit",
+	"users_login_links",
+	"users_codes",
+	"users_challenges",
+	"users_username_reservations",
+	"users_reviews",
+	"users_status_history",
+	"users_deletions",
+}
+
+// txPurgeUser deletes a user and everything stored about them.
+func txPurgeUser(tx *sqlx.Tx, userID int64) error {
+	err := txDeleteUserOutboxMessages(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range userTables {
+		cmd := fmt.Sprintf("DELETE FROM `%s` WHERE user_id=?", getTable(table))
+		_, err = tx.Exec(cmd, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the invitations belong to the people invited
+	cmd := fmt.Sprintf("UPDATE `%s` SET inviter_id=0 WHERE inviter_id=?", getTable("users_invitations"))
+	_, err = tx.Exec(cmd, userID)
+	if err != nil {
+		return err
+	}
+
+	cmd = fmt.Sprintf("DELETE FROM `%s` WHERE id=?", getTable("users"))
+	_, err = tx.Exec(cmd, userID)
+	return err
+}
+
+// txRevokeUserCredentials deletes every token that signs the user in or
+// changes the account, and the queued emails carrying them, and ends
+// running sessions.
+func txRevokeUserCredentials(tx *sqlx.Tx, userID int64) error {
+	err := txDeleteUserOutboxMessages(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"users_confirmations", "users_remembered", "users_resets", "users_email_reverts", "users_login_links", "users_codes", "users_challenges"} {
+		cmd := fmt.Sprintf("DELETE FROM `%s` WHERE user_id=?", getTable(table))
+		_, err = tx.Exec(cmd, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return dbTxIncrementUserForceLogout(tx, userID)
+}
+
+// txDeleteUserOutboxMessages deletes the queued emails to the user's
+// address and to the addresses of pending email changes, which hold the
+// address and live tokens. It has to run before the confirmations and
+// reverts are deleted.
+func txDeleteUserOutboxMessages(tx *sqlx.Tx, userID int64) error {
+	cmd := fmt.Sprintf(
+		"DELETE FROM `%s` WHERE recipient IN (SELECT email FROM `%s` WHERE id=? UNION SELECT email FROM `%s` WHERE user_id=? UNION SELECT email FROM `%s` WHERE user_id=?)",
+		getTable("auth_outbox"),
+		getTable("users"),
+		getTable("users_confirmations"),
+		getTable("users_email_reverts"),
+	)
+	_, err := tx.Exec(cmd, userID, userID, userID)
+	return err
+}
+
+func dbTxCreateUserDeletion(tx *sqlx.Tx, d *UserDeletion) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users_deletions"),
+		[]string{"user_id", "selector", "token", "purge", "created"},
+		d.UserID,
+		d.Selector,
+		d.Token,
+		d.Purge,
+		d.Created,
+	)
+}
+func dbGetUserDeletionBySelector(db *sqlx.DB, selector string) (*UserDeletion, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE selector=?", getTable("users_deletions"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(selector)
+
+	str := new(UserDeletion)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+func dbGetUserDeletionByUserID(db *sqlx.DB, userID int64) (*UserDeletion, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE user_id=?", getTable("users_deletions"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(userID)
+
+	str := new(UserDeletion)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+func dbGetUserIDsDeletionDue(db *sqlx.DB, now int64) ([]int64, error) {
+	cmd := fmt.Sprintf("SELECT user_id FROM `%s` WHERE purge<=? ORDER BY id", getTable("users_deletions"))
+
+	ids := make([]int64, 0)
+	err := db.Select(&ids, cmd, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+func dbTxDeleteUserDeletion(tx *sqlx.Tx, selector string) (int64, error) {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE selector=?", getTable("users_deletions"))
+	result, err := tx.Exec(cmd, selector)
+	if err != nil {
+		return -999, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/stockholmr/database"
+	"time"
+)
+
+type UserEmailRevert struct {
+	ID       *sql.NullInt64  `db:"id"`
+	UserID   *sql.NullInt64  `db:"user_id"`
+	Email    *sql.NullString `db:"email"`
+	Selector *sql.NullString `db:"selector"`
+	Token    *sql.NullString `db:"token"`
+	Expires  *sql.NullInt64  `db:"expires"`
+
+	_token string
+}
+
+func NewUserEmailRevert(userID int64, email string, expires int64) *UserEmailRevert {
+	selector, token, hash := createTokenAuthenticator()
+	return &UserEmailRevert{
+		UserID:   newNullInt64(userID),
+		Email:    newNullString(email),
+		Selector: newNullString(selector),
+		Token:    newNullString(hash),
+		Expires:  newNullInt64(expires),
+		_token:   token,
+	}
+}
+
+func (r *UserEmailRevert) GetToken() string {
+	return r._token
+}
+func (r *UserEmailRevert) GetSelector() string {
+	return r.Selector.String
+}
+func (r *UserEmailRevert) HasExpired() bool {
+	return time.Now().Unix() > r.Expires.Int64
+}
+
+func dbTxCreateUserEmailRevert(tx *sqlx.Tx, r *UserEmailRevert) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users_email_reverts"),
+		[]string{"user_id", "email", "selector", "token", "expires"},
+		r.UserID,
+		r.Email,
+		r.Selector,
+		r.Token,
+		r.Expires,
+	)
+}
+func dbGetUserEmailRevertBySelector(db *sqlx.DB, selector string) (*UserEmailRevert, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE selector=?", getTable("users_email_reverts"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(selector)
+
+	str := new(UserEmailRevert)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+func dbGetUserEmailRevertByUserID(db *sqlx.DB, userID int64) ([]*UserEmailRevert, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE user_id=? ORDER BY id", getTable("users_email_reverts"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Queryx(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	strArr := make([]*UserEmailRevert, 0)
+	for rows.Next() {
+		str := new(UserEmailRevert)
+		err = rows.StructScan(str)
+		if err != nil {
+			return nil, err
+		}
+		strArr = append(strArr, str)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return strArr, nil
+}
+func dbDeleteUserEmailRevert(db *sqlx.DB, selector string) error {
+	err := database.Delete(
+		db,
+		getTable("users_email_reverts"),
+		database.NewFieldValuePair("selector", selector),
+	)
+	return err
+}
+func dbTxDeleteUserEmailRevertAllByUserID(tx *sqlx.Tx, userID int64) error {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE user_id=?", getTable("users_email_reverts"))
+	_, err := tx.Exec(cmd, userID)
+	return err
+}
@@ -0,0 +1,309 @@
+package auth
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// userExport is the document written by ExportUserData. Password hashes,
+// selectors, tokens and codes are never part of it; where a secret exists
+// only the fact that it does is exported.
+type userExport struct {
+	Generated       time.Time            `json:"generated"`
+	Account         exportAccount        `json:"account"`
+	TwoFactor       exportTwoFactor      `json:"two_factor"`
+	Sessions        exportSessions       `json:"sessions"`
+	Confirmations   []exportConfirmation `json:"confirmations"`
+	RememberTokens  []exportToken        `json:"remember_tokens"`
+	PasswordResets  []exportToken        `json:"password_resets"`
+	PasswordChanges []*time.Time         `json:"password_changes"`
+	EmailReverts    []exportEmailRevert  `json:"email_reverts"`
+	StatusHistory   []exportStatusChange `json:"status_history"`
+	AuditEvents     []exportAuditEvent   `json:"audit_events"`
+	Reviews         []exportReview       `json:"reviews"`
+	FormerUsernames []exportUsername     `json:"former_usernames"`
+	Invitations     []exportInvitation   `json:"invitations"`
+	Deletion        *exportDeletion      `json:"deletion"`
+}
+type exportAccount struct {
+	ID                 int64      `json:"id"`
+	Email              string     `json:"email"`
+	Username           string     `json:"username"`
+	Password           string     `json:"password"`
+	Status             int64      `json:"status"`
+	StatusUntil        *time.Time `json:"status_until"`
+	Verified           bool       `json:"verified"`
+	Resettable         bool       `json:"resettable"`
+	Roles              int64      `json:"roles"`
+	Locale             string     `json:"locale"`
+	Registered         *time.Time `json:"registered"`
+	PasswordChanged    *time.Time `json:"password_changed"`
+	MustChangePassword bool       `json:"must_change_password"`
+}
+type exportTwoFactor struct {
+	Phone         string `json:"phone"`
+	PhoneVerified bool   `json:"phone_verified"`
+	PhoneEnabled  bool   `json:"phone_enabled"`
+}
+type exportSessions struct {
+	LastLogin   *time.Time `json:"last_login"`
+	ForceLogout int64      `json:"force_logout"`
+}
+type exportConfirmation struct {
+	Email   string     `json:"email"`
+	Created *time.Time `json:"created"`
+	Expires *time.Time `json:"expires"`
+}
+type exportToken struct {
+	ID      int64      `json:"id"`
+	Expires *time.Time `json:"expires"`
+}
+type exportEmailRevert struct {
+	Email   string     `json:"email"`
+	Expires *time.Time `json:"expires"`
+}
+type exportStatusChange struct {
+	Status  int64      `json:"status"`
+	Reason  string     `json:"reason"`
+	Until   *time.Time `json:"until"`
+	Created *time.Time `json:"created"`
+}
+type exportAuditEvent struct {
+	Event   string     `json:"event"`
+	Created *time.Time `json:"created"`
+}
+type exportReview struct {
+	Decision string     `json:"decision"`
+	Reason   string     `json:"reason"`
+	Created  *time.Time `json:"created"`
+}
+type exportUsername struct {
+	Username      string     `json:"username"`
+	ReservedUntil *time.Time `json:"reserved_until"`
+}
+type exportInvitation struct {
+	Email   string     `json:"email"`
+	Roles   int64      `json:"roles"`
+	Token   string     `json:"token"`
+	Created *time.Time `json:"created"`
+	Expires *time.Time `json:"expires"`
+}
+type exportDeletion struct {
+	Requested *time.Time `json:"requested"`
+	Purge     *time.Time `json:"purge"`
+}
+
+// the value exported in place of a secret that is set
+const exportRedacted = "[redacted]"
+
+func exportTime(v *sql.NullInt64) *time.Time {
+	if v == nil || !v.Valid || v.Int64 == 0 {
+		return nil
+	}
+	t := time.Unix(v.Int64, 0).UTC()
+	return &t
+}
+
+func exportString(v *sql.NullString) string {
+	if v == nil || !v.Valid {
+		return ""
+	}
+	return v.String
+}
+
+func buildUserExport(db *sqlx.DB, user *User) (*userExport, error) {
+	userID := user.GetID()
+
+	e := &userExport{
+		Generated: time.Now().UTC(),
+		Account: exportAccount{
+			ID:                 userID,
+			Email:              user.Email.String,
+			Username:           user.GetUsername(),
+			Status:             user.Status.Int64,
+			StatusUntil:        exportTime(user.StatusUntil),
+			Verified:           user.IsVerified(),
+			Resettable:         user.IsResettable(),
+			Roles:              user.Roles.Int64,
+			Locale:             exportString(user.Locale),
+			Registered:         exportTime(user.Registered),
+			PasswordChanged:    exportTime(user.PasswordChanged),
+			MustChangePassword: user.IsPasswordChangeRequired(),
+		},
+		TwoFactor: exportTwoFactor{
+			Phone:         exportString(user.Phone),
+			PhoneVerified: user.IsPhoneVerified(),
+			PhoneEnabled:  user.IsPhoneTwoFactorEnabled(),
+		},
+		Sessions: exportSessions{
+			LastLogin:   exportTime(user.LastLogin),
+			ForceLogout: user.ForceLogout.Int64,
+		},
+		Confirmations:   make([]exportConfirmation, 0),
+		RememberTokens:  make([]exportToken, 0),
+		PasswordResets:  make([]exportToken, 0),
+		PasswordChanges: make([]*time.Time, 0),
+		EmailReverts:    make([]exportEmailRevert, 0),
+		StatusHistory:   make([]exportStatusChange, 0),
+		AuditEvents:     make([]exportAuditEvent, 0),
+		Reviews:         make([]exportReview, 0),
+		FormerUsernames: make([]exportUsername, 0),
+		Invitations:     make([]exportInvitation, 0),
+	}
+
+	if user.Password.String != "" {
+		e.Account.Password = exportRedacted
+	}
+
+	confirmations, err := dbGetUserConfirmationByUserID(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range confirmations {
+		e.Confirmations = append(e.Confirmations, exportConfirmation{
+			Email:   c.Email.String,
+			Created: exportTime(c.Created),
+			Expires: exportTime(c.Expires),
+		})
+	}
+
+	remembered, err := dbGetUserRememberByUserID(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range remembered {
+		if r.HasExpired() {
+			continue
+		}
+		e.RememberTokens = append(e.RememberTokens, exportToken{ID: r.ID.Int64, Expires: exportTime(r.Expires)})
+	}
+
+	resets, err := dbGetUserResetByUserID(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range resets {
+		e.PasswordResets = append(e.PasswordResets, exportToken{ID: r.ID.Int64, Expires: exportTime(r.Expires)})
+	}
+
+	history, err := dbGetUserPasswordHistoryByUserID(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range history {
+		e.PasswordChanges = append(e.PasswordChanges, exportTime(h.Created))
+	}
+
+	reverts, err := dbGetUserEmailRevertByUserID(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range reverts {
+		e.EmailReverts = append(e.EmailReverts, exportEmailRevert{Email: r.Email.String, Expires: exportTime(r.Expires)})
+	}
+
+	// the moderator behind a status change is not the user's data
+	changes, err := dbGetUserStatusChangesByUserID(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range changes {
+		e.StatusHistory = append(e.StatusHistory, exportStatusChange{
+			Status:  c.Status.Int64,
+			Reason:  c.GetReason(),
+			Until:   exportTime(c.Until),
+			Created: exportTime(c.Created),
+		})
+	}
+
+	events, err := dbGetUserAuditEventsByUserID(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range events {
+		e.AuditEvents = append(e.AuditEvents, exportAuditEvent{Event: a.Event.String, Created: exportTime(a.Created)})
+	}
+
+	// like status changes, without the moderator
+	reviews, err := dbGetUserReviewsByUserID(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range reviews {
+		e.Reviews = append(e.Reviews, exportReview{
+			Decision: r.Decision.String,
+			Reason:   r.Reason.String,
+			Created:  exportTime(r.Created),
+		})
+	}
+
+	// only the normalized form of a former username is kept
+	reservations, err := dbGetUserUsernameReservationsByUserID(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range reservations {
+		e.FormerUsernames = append(e.FormerUsernames, exportUsername{
+			Username:      r.UsernameKey.String,
+			ReservedUntil: exportTime(r.Expires),
+		})
+	}
+
+	invitations, err := dbGetUserInvitationsByEmail(db, user.Email.String)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range invitations {
+		e.Invitations = append(e.Invitations, exportInvitation{
+			Email:   i.Email.String,
+			Roles:   i.Roles.Int64,
+			Token:   exportRedacted,
+			Created: exportTime(i.Created),
+			Expires: exportTime(i.Expires),
+		})
+	}
+
+	deletion, err := dbGetUserDeletionByUserID(db, userID)
+	if err != nil && err.Error() != "sql: no rows in result set" {
+		return nil, err
+	}
+	if deletion != nil {
+		e.Deletion = &exportDeletion{Requested: exportTime(deletion.Created), Purge: exportTime(deletion.Purge)}
+	}
+
+	return e, nil
+}
+
+func zipUserExport(doc []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+
+	f, err := w.CreateHeader(&zip.FileHeader{
+		Name:     "user-data.json",
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Write(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func marshalUserExport(e *userExport) ([]byte, error) {
+	return json.MarshalIndent(e, "", "  ")
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+type UserInvitation struct {
+	ID        *sql.NullInt64  `db:"id"`
+	InviterID *sql.NullInt64  `db:"inviter_id"`
+	Email     *sql.NullString `db:"email"`
+	EmailKey  *sql.NullString `db:"email_key"`
+	Roles     *sql.NullInt64  `db:"roles_mask"`
+	Selector  *sql.NullString `db:"selector"`
+	Token     *sql.NullString `db:"token"`
+	Expires   *sql.NullInt64  `db:"expires"`
+	Created   *sql.NullInt64  `db:"created"`
+
+	_token string
+}
+
+func NewUserInvitation(inviterID int64, email string, roles int64, expires int64) *UserInvitation {
+	selector, token, hash := createTokenAuthenticator()
+	return &UserInvitation{
+		InviterID: newNullInt64(inviterID),
+		Email:     newNullString(email),
+		EmailKey:  newNullString(emailKey(email)),
+		Roles:     newNullInt64(roles),
+		Selector:  newNullString(selector),
+		Token:     newNullString(hash),
+		Expires:   newNullInt64(expires),
+		Created:   newNullInt64(time.Now().Unix()),
+		_token:    token,
+	}
+}
+
+func (i *UserInvitation) GetID() int64 {
+	return i.ID.Int64
+}
+func (i *UserInvitation) GetToken() string {
+	return i._token
+}
+func (i *UserInvitation) GetSelector() string {
+	return i.Selector.String
+}
+func (i *UserInvitation) HasExpired() bool {
+	return time.Now().Unix() > i.Expires.Int64
+}
+
+func dbTxCreateUserInvitation(tx *sqlx.Tx, i *UserInvitation) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users_invitations"),
+		[]string{"inviter_id", "email", "email_key", "roles_mask", "selector", "token", "expires", "created"},
+		i.InviterID,
+		i.Email,
+		i.EmailKey,
+		i.Roles,
+		i.Selector,
+		i.Token,
+		i.Expires,
+		i.Created,
+	)
+}
+func dbGetUserInvitationBySelector(db *sqlx.DB, selector string) (*UserInvitation, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE selector=?", getTable("users_invitations"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(selector)
+
+	str := new(UserInvitation)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+func dbGetUserInvitationsPending(db *sqlx.DB, now int64) ([]*UserInvitation, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE expires>=? ORDER BY id", getTable("users_invitations"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Queryx(now)
+	if err != nil {
+		return nil, err
+	}
+
+	strArr := make([]*UserInvitation, 0)
+	for rows.Next() {
+		str := new(UserInvitation)
+		err = rows.StructScan(str)
+		if err != nil {
+			return nil, err
+		}
+		strArr = append(strArr, str)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return strArr, nil
+}
+func dbGetUserInvitationsByEmail(db *sqlx.DB, email string) ([]*UserInvitation, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE email_key=? ORDER BY id", getTable("users_invitations"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Queryx(emailKey(email))
+	if err != nil {
+		return nil, err
+	}
+
+	strArr := make([]*UserInvitation, 0)
+	for rows.Next() {
+		str := new(UserInvitation)
+		err = rows.StructScan(str)
+		if err != nil {
+			return nil, err
+		}
+		strArr = append(strArr, str)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return strArr, nil
+}
+func dbDeleteUserInvitation(db *sqlx.DB, id int64) (int64, error) {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE id=?", getTable("users_invitations"))
+	result, err := db.Exec(cmd, id)
+	if err != nil {
+		return -999, err
+	}
+	return result.RowsAffected()
+}
+func dbTxDeleteUserInvitation(tx *sqlx.Tx, selector string) (int64, error) {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE selector=?", getTable("users_invitations"))
+	result, err := tx.Exec(cmd, selector)
+	if err != nil {
+		return -999, err
+	}
+	return result.RowsAffected()
+}
+func dbTxDeleteUserInvitationByEmail(tx *sqlx.Tx, email string) error {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE email_key=?", getTable("users_invitations"))
+	_, err := tx.Exec(cmd, emailKey(email))
+	return err
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/stockholmr/database"
+	"time"
+)
+
+type UserLoginLink struct {
+	ID       *sql.NullInt64  `db:"id"`
+	UserID   *sql.NullInt64  `db:"user_id"`
+	Selector *sql.NullString `db:"selector"`
+	Token    *sql.NullString `db:"token"`
+	Expires  *sql.NullInt64  `db:"expires"`
+
+	_token string
+}
+
+func NewUserLoginLink(userID int64, expires int64) *UserLoginLink {
+	selector, token, hash := createTokenAuthenticator()
+	return &UserLoginLink{
+		UserID:   newNullInt64(userID),
+		Selector: newNullString(selector),
+		Token:    newNullString(hash),
+		Expires:  newNullInt64(expires),
+		_token:   token,
+	}
+}
+
+func (l *UserLoginLink) GetToken() string {
+	return l._token
+}
+func (l *UserLoginLink) GetSelector() string {
+	return l.Selector.String
+}
+func (l *UserLoginLink) HasExpired() bool {
+	return time.Now().Unix() > l.Expires.Int64
+}
+
+func dbTxCreateUserLoginLink(tx *sqlx.Tx, l *UserLoginLink) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users_login_links"),
+		[]string{"user_id", "selector", "token", "expires"},
+		l.UserID,
+		l.Selector,
+		l.Token,
+		l.Expires,
+	)
+}
+
+// dbTxDeleteUserLoginLink returns how many rows were deleted, so concurrent
+// uses of the same link can tell which one consumed it.
+func dbTxDeleteUserLoginLink(tx *sqlx.Tx, selector string) (int64, error) {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE selector=?", getTable("users_login_links"))
+	result, err := tx.Exec(cmd, selector)
+	if err != nil {
+		return -999, err
+	}
+	return result.RowsAffected()
+}
+func dbDeleteUserLoginLink(db *sqlx.DB, selector string) error {
+	err := database.Delete(
+		db,
+		getTable("users_login_links"),
+		database.NewFieldValuePair("selector", selector),
+	)
+	return err
+}
+func dbTxDeleteUserLoginLinkByUserID(tx *sqlx.Tx, userID int64) error {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE user_id=?", getTable("users_login_links"))
+	_, err := tx.Exec(cmd, userID)
+	return err
+}
+func dbGetUserLoginLinkBySelector(db *sqlx.DB, selector string) (*UserLoginLink, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE selector=?", getTable("users_login_links"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(selector)
+
+	str := new(UserLoginLink)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
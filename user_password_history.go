@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+type UserPasswordHistory struct {
+	ID       *sql.NullInt64  `db:"id"`
+	UserID   *sql.NullInt64  `db:"user_id"`
+	Password *sql.NullString `db:"password"`
+	Created  *sql.NullInt64  `db:"created"`
+}
+
+func NewUserPasswordHistory(userID int64, password string, created int64) *UserPasswordHistory {
+	return &UserPasswordHistory{
+		UserID:   newNullInt64(userID),
+		Password: newNullString(password),
+		Created:  newNullInt64(created),
+	}
+}
+
+// checkPasswordAge rejects a voluntary change made before the minimum
+// password age has passed.
+func checkPasswordAge(user *User) error {
+	// a forced change must not be held back by the minimum age
+	if user.IsPasswordChangeRequired() || !user.PasswordChanged.Valid {
+		return nil
+	}
+
+	if time.Now().Unix()-user.PasswordChanged.Int64 < getMinPasswordAge() {
+		return errors.New(ERROR_PASSWORDTOOYOUNG)
+	}
+
+	return nil
+}
+
+// checkPasswordHistory rejects passwords matching the current one or any of
+// the remembered previous ones.
+func checkPasswordHistory(db *sqlx.DB, user *User, password string) error {
+	history, err := dbGetUserPasswordHistoryByUserID(db, user.GetID())
+	if err != nil {
+		return err
+	}
+
+	if verifyHash(user.Password.String, password) {
+		return errors.New(ERROR_PASSWORDREUSED)
+	}
+
+	for _, h := range history {
+		if verifyHash(h.Password.String, password) {
+			return errors.New(ERROR_PASSWORDREUSED)
+		}
+	}
+
+	return nil
+}
+
+// txRecordPasswordHistory keeps the replaced hash and drops the ones beyond
+// the configured history length.
+func txRecordPasswordHistory(tx *sqlx.Tx, userID int64, oldPassword string) error {
+	keep := getPasswordHistoryLength()
+	if keep <= 0 {
+		return nil
+	}
+
+	_, err := dbTxCreateUserPasswordHistory(tx, NewUserPasswordHistory(userID, oldPassword, time.Now().Unix()))
+	if err != nil {
+		return err
+	}
+
+	return dbTxTrimUserPasswordHistory(tx, userID, keep)
+}
+
+func dbTxCreateUserPasswordHistory(tx *sqlx.Tx, h *UserPasswordHistory) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users_password_history"),
+		[]string{"user_id", "password", "created"},
+		h.UserID,
+		h.Password,
+		h.Created,
+	)
+}
+func dbTxTrimUserPasswordHistory(tx *sqlx.Tx, userID int64, keep int64) error {
+	table := getTable("users_password_history")
+	cmd := fmt.Sprintf(
+		"DELETE FROM `%s` WHERE user_id=? AND id NOT IN (SELECT id FROM `%s` WHERE user_id=? ORDER BY id DESC LIMIT ?)",
+		table,
+		table,
+	)
+
+	_, err := tx.Exec(cmd, userID, userID, keep)
+	return err
+}
+func dbGetUserPasswordHistoryByUserID(db *sqlx.DB, userID int64) ([]*UserPasswordHistory, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE user_id=? ORDER BY id DESC", getTable("users_password_history"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Queryx(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	strArr := make([]*UserPasswordHistory, 0)
+	for rows.Next() {
+		str := new(UserPasswordHistory)
+		err = rows.StructScan(str)
+		if err != nil {
+			return nil, err
+		}
+		strArr = append(strArr, str)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return strArr, nil
+}
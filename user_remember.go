@@ -56,6 +56,17 @@ func dbCreateUserRemember(db *sqlx.DB, r *UserRemember) (int64, error) {
 
 	return id.Int64, nil
 }
+func dbTxCreateUserRemember(tx *sqlx.Tx, r *UserRemember) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users_remembered"),
+		[]string{"user_id", "selector", "token", "expires"},
+		r.UserID,
+		r.Selector,
+		r.Token,
+		r.Expires,
+	)
+}
 func dbDeleteUserRemember(db *sqlx.DB, selector string) error {
 	err := database.Delete(
 		db,
@@ -72,6 +83,11 @@ func dbDeleteAllUserRememberedByUserID(db *sqlx.DB, userID int64) error {
 	)
 	return err
 }
+func dbTxDeleteAllUserRememberedByUserID(tx *sqlx.Tx, userID int64) error {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE user_id=?", getTable("users_remembered"))
+	_, err := tx.Exec(cmd, userID)
+	return err
+}
 func dbGetUserRememberBySelector(db *sqlx.DB, selector string) (*UserRemember, error) {
 	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE selector=?", getTable("users_remembered"))
 
@@ -56,6 +56,17 @@ func dbCreateUserReset(db *sqlx.DB, r *UserReset) (int64, error) {
 
 	return id.Int64, nil
 }
+func dbTxCreateUserReset(tx *sqlx.Tx, r *UserReset) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users_resets"),
+		[]string{"user_id", "selector", "token", "expires"},
+		r.UserID,
+		r.Selector,
+		r.Token,
+		r.Expires,
+	)
+}
 func dbDeleteUserReset(db *sqlx.DB, selector string) error {
 	err := database.Delete(
 		db,
@@ -72,14 +83,20 @@ func dbDeleteUserResetByUserID(db *sqlx.DB, userID int64) error {
 	)
 	return err
 }
+func dbTxDeleteUserResetByUserID(tx *sqlx.Tx, userID int64) error {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE user_id=?", getTable("users_resets"))
+	_, err := tx.Exec(cmd, userID)
+	return err
+}
 func dbGetUserResetCount(db *sqlx.DB, userID int64) (int64, error) {
-	cmd := fmt.Sprintf("SELECT COUNT(*) as COUNT FROM `%s` WHERE user_id=?", getTable("users_resets"))
+	// expired resets no longer count, whether or not they have been purged
+	cmd := fmt.Sprintf("SELECT COUNT(*) as COUNT FROM `%s` WHERE user_id=? AND expires>?", getTable("users_resets"))
 
 	stmt, err := db.Preparex(cmd)
 	if err != nil {
 		return -999, err
 	}
-	result := stmt.QueryRowx(userID)
+	result := stmt.QueryRowx(userID, time.Now().Unix())
 	str := make(map[string]interface{}, 0)
 	err = result.MapScan(str)
 
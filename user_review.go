@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// UserReview records a moderator's decision on a registration.
+type UserReview struct {
+	ID         *sql.NullInt64  `db:"id"`
+	UserID     *sql.NullInt64  `db:"user_id"`
+	ReviewerID *sql.NullInt64  `db:"reviewer_id"`
+	Decision   *sql.NullString `db:"decision"`
+	Reason     *sql.NullString `db:"reason"`
+	Created    *sql.NullInt64  `db:"created"`
+}
+
+// ReviewCallBack tells the owner of email about the decision on their
+// registration, REVIEW_APPROVED or REVIEW_REJECTED.
+type ReviewCallBack func(email string, decision string, reason string) error
+
+// ReviewNotSentError is returned by Approve and Reject when the decision was
+// stored but the ReviewCallBack failed.
+type ReviewNotSentError struct {
+	Err error
+}
+
+func (e *ReviewNotSentError) Error() string {
+	return ERROR_REVIEWNOTSENT
+}
+func (e *ReviewNotSentError) Unwrap() error {
+	return e.Err
+}
+
+func NewUserReview(userID int64, reviewerID int64, decision string, reason string) *UserReview {
+	return &UserReview{
+		UserID:     newNullInt64(userID),
+		ReviewerID: newNullInt64(reviewerID),
+		Decision:   newNullString(decision),
+		Reason:     newNullString(reason),
+		Created:    newNullInt64(time.Now().Unix()),
+	}
+}
+
+func dbTxCreateUserReview(tx *sqlx.Tx, r *UserReview) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users_reviews"),
+		[]string{"user_id", "reviewer_id", "decision", "reason", "created"},
+		r.UserID,
+		r.ReviewerID,
+		r.Decision,
+		r.Reason,
+		r.Created,
+	)
+}
+func dbGetUserReviewsByUserID(db *sqlx.DB, userID int64) ([]*UserReview, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE user_id=? ORDER BY id", getTable("users_reviews"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Queryx(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	strArr := make([]*UserReview, 0)
+	for rows.Next() {
+		str := new(UserReview)
+		err = rows.StructScan(str)
+		if err != nil {
+			return nil, err
+		}
+		strArr = append(strArr, str)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return strArr, nil
+}
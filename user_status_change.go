@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// UserStatusChange is an entry in the status history of a user: who moved
+// the account to Status, why, and until when. Until is zero for changes
+// without an end. ActorID is zero for automatic changes.
+type UserStatusChange struct {
+	ID      *sql.NullInt64  `db:"id"`
+	UserID  *sql.NullInt64  `db:"user_id"`
+	Status  *sql.NullInt64  `db:"status"`
+	Reason  *sql.NullString `db:"reason"`
+	ActorID *sql.NullInt64  `db:"actor_id"`
+	Until   *sql.NullInt64  `db:"until"`
+	Created *sql.NullInt64  `db:"created"`
+}
+
+func NewUserStatusChange(userID int64, status int64, reason string, actorID int64, until int64) *UserStatusChange {
+	return &UserStatusChange{
+		UserID:  newNullInt64(userID),
+		Status:  newNullInt64(status),
+		Reason:  newNullString(reason),
+		ActorID: newNullInt64(actorID),
+		Until:   newNullInt64(until),
+		Created: newNullInt64(time.Now().Unix()),
+	}
+}
+
+func (c *UserStatusChange) GetReason() string {
+	return c.Reason.String
+}
+
+// GetUntil returns when the status ends, or the zero time if it does not.
+func (c *UserStatusChange) GetUntil() time.Time {
+	if c.Until.Int64 == 0 {
+		return time.Time{}
+	}
+	return time.Unix(c.Until.Int64, 0)
+}
+
+// txChangeUserStatus moves a user from the status read into from to the one
+// in c and records why. It fails with ERROR_STATUSCHANGED if the status was
+// changed since, so for example lifting a suspension cannot undo a ban.
+func txChangeUserStatus(tx *sqlx.Tx, from *User, c *UserStatusChange) error {
+	cmd := fmt.Sprintf(
+		"UPDATE `%s` SET status=?, status_until=? WHERE id=? AND status=? AND status_until=?",
+		getTable("users"),
+	)
+	result, err := tx.Exec(cmd, c.Status, c.Until, from.GetID(), from.Status.Int64, from.StatusUntil.Int64)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if updated != 1 {
+		return errors.New(ERROR_STATUSCHANGED)
+	}
+
+	_, err = dbTxCreateUserStatusChange(tx, c)
+	return err
+}
+
+func dbTxCreateUserStatusChange(tx *sqlx.Tx, c *UserStatusChange) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users_status_history"),
+		[]string{"user_id", "status", "reason", "actor_id", "until", "created"},
+		c.UserID,
+		c.Status,
+		c.Reason,
+		c.ActorID,
+		c.Until,
+		c.Created,
+	)
+}
+func dbGetLatestUserStatusChange(db *sqlx.DB, userID int64) (*UserStatusChange, error) {
+	cmd := fmt.Sprintf(
+		"SELECT * FROM `%s` WHERE user_id=? ORDER BY id DESC LIMIT 1",
+		getTable("users_status_history"),
+	)
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(userID)
+
+	str := new(UserStatusChange)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+func dbGetUserStatusChangesByUserID(db *sqlx.DB, userID int64) ([]*UserStatusChange, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE user_id=? ORDER BY id", getTable("users_status_history"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Queryx(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	strArr := make([]*UserStatusChange, 0)
+	for rows.Next() {
+		str := new(UserStatusChange)
+		err = rows.StructScan(str)
+		if err != nil {
+			return nil, err
+		}
+		strArr = append(strArr, str)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return strArr, nil
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+)
+
+// UserUsernameReservation keeps a username a user gave up from being taken
+// by someone else until Expires, or forever if Expires is zero.
+type UserUsernameReservation struct {
+	ID          *sql.NullInt64  `db:"id"`
+	UserID      *sql.NullInt64  `db:"user_id"`
+	UsernameKey *sql.NullString `db:"username_key"`
+	Expires     *sql.NullInt64  `db:"expires"`
+}
+
+func dbTxCreateUserUsernameReservation(tx *sqlx.Tx, userID int64, key string, expires int64) (int64, error) {
+	return txInsert(
+		tx,
+		getTable("users_username_reservations"),
+		[]string{"user_id", "username_key", "expires"},
+		userID,
+		key,
+		expires,
+	)
+}
+func dbTxDeleteUserUsernameReservation(tx *sqlx.Tx, key string) error {
+	cmd := fmt.Sprintf("DELETE FROM `%s` WHERE username_key=?", getTable("users_username_reservations"))
+	_, err := tx.Exec(cmd, key)
+	return err
+}
+func dbGetUserUsernameReservation(db *sqlx.DB, key string, now int64) (*UserUsernameReservation, error) {
+	cmd := fmt.Sprintf(
+		"SELECT * FROM `%s` WHERE username_key=? AND (expires=0 OR expires>?)",
+		getTable("users_username_reservations"),
+	)
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result := stmt.QueryRowx(key, now)
+
+	str := new(UserUsernameReservation)
+	err = result.StructScan(str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return str, nil
+}
+func dbGetUserUsernameReservationsByUserID(db *sqlx.DB, userID int64) ([]*UserUsernameReservation, error) {
+	cmd := fmt.Sprintf("SELECT * FROM `%s` WHERE user_id=? ORDER BY id", getTable("users_username_reservations"))
+
+	stmt, err := db.Preparex(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Queryx(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	strArr := make([]*UserUsernameReservation, 0)
+	for rows.Next() {
+		str := new(UserUsernameReservation)
+		err = rows.StructScan(str)
+		if err != nil {
+			return nil, err
+		}
+		strArr = append(strArr, str)
+	}
+
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return strArr, nil
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// UsernamePolicy decides which usernames can be chosen. Usernames are
+// compared case-insensitively, so "JDoe" and "jdoe" are the same name.
+// Whatever the policy, a username never contains "@", which is how
+// LoginWithIdentifier tells it from an email address.
+//
+// A name given up through ChangeUsername stays reserved for its previous
+// owner for Reservation, or forever if Reservation is zero.
+type UsernamePolicy struct {
+	MinLength   int
+	MaxLength   int
+	Validator   func(s string) bool
+	Reserved    []string
+	Reservation time.Duration
+}
+
+func NewUsernamePolicy() *UsernamePolicy {
+	return &UsernamePolicy{
+		MinLength:   3,
+		MaxLength:   32,
+		Validator:   ValidateAlphanumericString,
+		Reserved:    []string{"admin", "administrator", "root", "support", "system"},
+		Reservation: time.Hour * 24 * 90,
+	}
+}
+
+func (p *UsernamePolicy) check(username string) bool {
+	length := utf8.RuneCountInString(username)
+	if length < p.MinLength || (p.MaxLength > 0 && length > p.MaxLength) {
+		return false
+	}
+
+	if p.Validator != nil && !p.Validator(username) {
+		return false
+	}
+
+	key := usernameKey(username)
+	for _, reserved := range p.Reserved {
+		if usernameKey(reserved) == key {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validUsername checks username against the configured policy, if any.
+func validUsername(username string) bool {
+	if username == "" || strings.Contains(username, "@") {
+		return false
+	}
+
+	policy := getUsernamePolicy()
+	return policy == nil || policy.check(username)
+}
+
+// usernameKey is the form usernames are unique in.
+func usernameKey(username string) string {
+	return strings.ToLower(norm.NFKC.String(strings.TrimSpace(username)))
+}